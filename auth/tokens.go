@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"kbt-cuy/models"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrInvalidToken is returned for a token that is unknown, expired or revoked
+var ErrInvalidToken = errors.New("token is invalid, expired or revoked")
+
+// Pair is what an API client gets when it logs in or refreshes
+type Pair struct {
+	AccessToken      string
+	AccessExpiresAt  time.Time
+	RefreshToken     string
+	RefreshExpiresAt time.Time
+}
+
+// Service issues the opaque bearer tokens of API clients and checks them
+type Service struct {
+	DB         *gorm.DB
+	AccessTTL  time.Duration // How long an access token is accepted
+	RefreshTTL time.Duration // How long a refresh token can be exchanged for a new pair
+}
+
+// Issue starts a new token family for the user and returns its first pair
+func (s *Service) Issue(userID uint) (Pair, error) {
+	family, err := randomToken()
+	if err != nil {
+		return Pair{}, err
+	}
+	return s.issue(userID, family, time.Now())
+}
+
+// Authenticate returns the stored access token the client sent
+func (s *Service) Authenticate(token string) (models.APIToken, error) {
+	var stored models.APIToken
+	err := s.DB.Where("hash = ? AND kind = ? AND revoked_at IS NULL AND expires_at > ?", hash(token), models.TokenAccess, time.Now()).
+		First(&stored).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return stored, ErrInvalidToken
+	}
+	return stored, err
+}
+
+// Refresh exchanges a refresh token for a new pair in the same family. A
+// refresh token works once: the pair it came with is revoked. Presenting it
+// again means it leaked, so the whole family is revoked.
+func (s *Service) Refresh(token string) (Pair, error) {
+	now := time.Now()
+	var stored models.APIToken
+	err := s.DB.Where("hash = ? AND kind = ?", hash(token), models.TokenRefresh).First(&stored).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return Pair{}, ErrInvalidToken
+	}
+	if err != nil {
+		return Pair{}, err
+	}
+	if !stored.ExpiresAt.After(now) {
+		return Pair{}, ErrInvalidToken
+	}
+
+	// Conditional, so of two clients refreshing at once only one succeeds
+	result := s.DB.Model(&models.APIToken{}).Where("id = ? AND revoked_at IS NULL", stored.ID).Update("revoked_at", now)
+	if result.Error != nil {
+		return Pair{}, result.Error
+	}
+	if result.RowsAffected == 0 {
+		log.Printf("[AUTH] Refresh token of user %d reused, revoking its family", stored.UserID)
+		if err := s.Revoke(stored.Family); err != nil {
+			return Pair{}, err
+		}
+		return Pair{}, ErrInvalidToken
+	}
+
+	if err := s.Revoke(stored.Family); err != nil {
+		return Pair{}, err
+	}
+	return s.issue(stored.UserID, stored.Family, now)
+}
+
+// Revoke revokes every token of a family, e.g. when the client logs out
+func (s *Service) Revoke(family string) error {
+	return s.DB.Model(&models.APIToken{}).
+		Where("family = ? AND revoked_at IS NULL", family).
+		Update("revoked_at", time.Now()).Error
+}
+
+// issue stores a new access and refresh token in the family
+func (s *Service) issue(userID uint, family string, now time.Time) (Pair, error) {
+	access, err := randomToken()
+	if err != nil {
+		return Pair{}, err
+	}
+	refresh, err := randomToken()
+	if err != nil {
+		return Pair{}, err
+	}
+
+	pair := Pair{
+		AccessToken:      access,
+		AccessExpiresAt:  now.Add(s.AccessTTL),
+		RefreshToken:     refresh,
+		RefreshExpiresAt: now.Add(s.RefreshTTL),
+	}
+	err = s.DB.Create(&[]models.APIToken{
+		{UserID: userID, Kind: models.TokenAccess, Hash: hash(access), Family: family, ExpiresAt: pair.AccessExpiresAt},
+		{UserID: userID, Kind: models.TokenRefresh, Hash: hash(refresh), Family: family, ExpiresAt: pair.RefreshExpiresAt},
+	}).Error
+	return pair, err
+}
+
+// randomToken returns 32 random bytes, hex encoded
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hash is what is stored instead of the token, a leaked table can't be
+// used to authenticate
+func hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
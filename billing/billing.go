@@ -0,0 +1,162 @@
+package billing
+
+import (
+	"fmt"
+	"kbt-cuy/models"
+	"log"
+	"time"
+
+	"github.com/midtrans/midtrans-go"
+	"github.com/midtrans/midtrans-go/coreapi"
+	"gorm.io/gorm"
+)
+
+// Refunder is the part of the Midtrans core API client used to give money back
+type Refunder interface {
+	RefundTransaction(orderID string, req *coreapi.RefundReq) (*coreapi.RefundResponse, *midtrans.Error)
+}
+
+// RetryDelay is how long a failed refund waits before it is sent again
+const RetryDelay = 10 * time.Minute
+
+// Service records money movements in the ledger and settles deposits
+type Service struct {
+	DB       *gorm.DB
+	Midtrans Refunder
+}
+
+// RecordDeposit books the up-front payment of a rental. Pass the DB
+// transaction that marks the rental as paid.
+func RecordDeposit(db *gorm.DB, tx models.Transaction) error {
+	return db.Create(&models.LedgerEntry{
+		TransactionID: tx.ID,
+		Kind:          models.LedgerDeposit,
+		Amount:        tx.GrossAmount,
+		Status:        models.LedgerSucceeded,
+		Reference:     tx.OrderID,
+	}).Error
+}
+
+// Settle books the final charge of a returned rental and refunds the part
+// of the deposit not needed for the charge and any late fees. Amounts owed
+// above the deposit are recorded but left outstanding. Settling the same
+// rental twice is a no-op.
+func (s *Service) Settle(tx models.Transaction) error {
+	var penalties int64
+	if err := s.DB.Model(&models.LedgerEntry{}).
+		Where("transaction_id = ? AND kind IN ?", tx.ID, []string{models.LedgerLateFee, models.LedgerForfeit}).
+		Select("COALESCE(SUM(amount), 0)").Scan(&penalties).Error; err != nil {
+		return err
+	}
+	due := tx.FinalAmount + penalties
+
+	var settled int64
+	if err := s.DB.Model(&models.LedgerEntry{}).
+		Where("transaction_id = ? AND kind = ?", tx.ID, models.LedgerCharge).
+		Count(&settled).Error; err != nil {
+		return err
+	}
+	if settled == 0 {
+		note := ""
+		if due > tx.GrossAmount {
+			note = fmt.Sprintf("%d outstanding above deposit", due-tx.GrossAmount)
+		}
+		if err := s.DB.Create(&models.LedgerEntry{
+			TransactionID: tx.ID,
+			Kind:          models.LedgerCharge,
+			Amount:        tx.FinalAmount,
+			Status:        models.LedgerSucceeded,
+			Reference:     tx.OrderID,
+			Note:          note,
+		}).Error; err != nil {
+			return err
+		}
+	}
+
+	if due >= tx.GrossAmount {
+		return nil
+	}
+	return s.refund(tx, tx.GrossAmount-due, "settle", "Unused powerbank rental deposit")
+}
+
+// RetrySettlements settles again every returned rental whose refund of the
+// unused deposit failed and returns how many got their refund
+func (s *Service) RetrySettlements(now time.Time) (int, error) {
+	var rentals []models.Transaction
+	if err := s.DB.Scopes(RefundDue(now)).Where("status = ?", models.StatusReturned).
+		Where("EXISTS (SELECT 1 FROM ledger_entries WHERE ledger_entries.transaction_id = transactions.id AND ledger_entries.deleted_at IS NULL AND kind = ? AND status = ?)",
+			models.LedgerRefund, models.LedgerFailed).
+		Find(&rentals).Error; err != nil {
+		return 0, err
+	}
+
+	settled := 0
+	for _, tx := range rentals {
+		if err := s.Settle(tx); err != nil {
+			continue
+		}
+		settled++
+	}
+	return settled, nil
+}
+
+// RefundAll gives back the whole deposit of a rental that never started
+func (s *Service) RefundAll(tx models.Transaction, reason string) error {
+	return s.refund(tx, tx.GrossAmount, "full", reason)
+}
+
+// RefundDue narrows a query on transactions to paid rentals that got no
+// refund yet and had no refund attempt within the last RetryDelay
+func RefundDue(now time.Time) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.
+			Where("EXISTS (SELECT 1 FROM ledger_entries WHERE ledger_entries.transaction_id = transactions.id AND ledger_entries.deleted_at IS NULL AND kind = ? AND status = ?)",
+				models.LedgerDeposit, models.LedgerSucceeded).
+			Where("NOT EXISTS (SELECT 1 FROM ledger_entries WHERE ledger_entries.transaction_id = transactions.id AND ledger_entries.deleted_at IS NULL AND kind = ? AND (status = ? OR created_at > ?))",
+				models.LedgerRefund, models.LedgerSucceeded, now.Add(-RetryDelay))
+	}
+}
+
+// refund sends a refund through Midtrans and books the outcome. The refund
+// key is derived from the order, so Midtrans ignores a repeated request and
+// a refund that already succeeded is never sent again.
+func (s *Service) refund(tx models.Transaction, amount int64, purpose string, reason string) error {
+	refundKey := tx.OrderID + "-" + purpose
+
+	var done int64
+	if err := s.DB.Model(&models.LedgerEntry{}).
+		Where("transaction_id = ? AND kind = ? AND reference = ? AND status = ?",
+			tx.ID, models.LedgerRefund, refundKey, models.LedgerSucceeded).
+		Count(&done).Error; err != nil {
+		return err
+	}
+	if done > 0 || amount <= 0 {
+		return nil
+	}
+
+	entry := models.LedgerEntry{
+		TransactionID: tx.ID,
+		Kind:          models.LedgerRefund,
+		Amount:        amount,
+		Status:        models.LedgerSucceeded,
+		Reference:     refundKey,
+		Note:          reason,
+	}
+
+	var refundErr error
+	if _, merr := s.Midtrans.RefundTransaction(tx.OrderID, &coreapi.RefundReq{
+		RefundKey: refundKey,
+		Amount:    amount,
+		Reason:    reason,
+	}); merr != nil {
+		refundErr = merr
+		entry.Status = models.LedgerFailed
+		entry.Note = reason + ": " + merr.GetMessage()
+		log.Printf("[BILLING] Refund of %d for order %s failed: %s", amount, tx.OrderID, merr.GetMessage())
+	}
+
+	if err := s.DB.Create(&entry).Error; err != nil {
+		return err
+	}
+	return refundErr
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"kbt-cuy/config"
+	database "kbt-cuy/db"
+	"kbt-cuy/migrations"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+const usage = `Usage: go run ./cmd/backup <command>
+
+Commands:
+  create [file]   write every table to a backup archive (default backup-<timestamp>.jsonl)
+  restore <file>  load an archive into an empty database`
+
+// archiveFormat and archiveVersion identify the file layout, so later
+// changes to the layout can still read old archives
+const (
+	archiveFormat  = "kbt-cuy-backup"
+	archiveVersion = 1
+)
+
+// header is the first line of an archive
+type header struct {
+	Format        string         `json:"format"`
+	Version       int            `json:"version"`
+	SchemaVersion int            `json:"schema_version"`
+	CreatedAt     time.Time      `json:"created_at"`
+	Tables        map[string]int `json:"tables"` // Row count per table
+}
+
+// record is every following line of an archive: one row of one table
+type record struct {
+	Table string                 `json:"table"`
+	Row   map[string]interface{} `json:"row"`
+}
+
+// backup exports the database as JSON lines and restores it again. Rows are
+// copied as stored, so password hashes never leave their hashed form.
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Println(usage)
+		os.Exit(2)
+	}
+
+	config.LoadConfig()
+
+	db, err := database.Open(config.DatabaseURL)
+	if err != nil {
+		log.Fatal("Failed to connect to database:", err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		log.Fatal("Failed to connect to database:", err)
+	}
+
+	switch os.Args[1] {
+	case "create":
+		path := fmt.Sprintf("backup-%s.jsonl", time.Now().Format("20060102-150405"))
+		if len(os.Args) > 2 {
+			path = os.Args[2]
+		}
+		schemaVersion, err := migrations.CurrentVersion(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := create(sqlDB, schemaVersion, path); err != nil {
+			os.Remove(path)
+			log.Fatal("Backup failed: ", err)
+		}
+
+	case "restore":
+		if len(os.Args) < 3 {
+			log.Fatal("restore expects the archive to load")
+		}
+		// An empty database is migrated first so the tables exist
+		current, err := migrations.CurrentVersion(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if current == 0 {
+			if _, err := migrations.Up(db); err != nil {
+				log.Fatal(err)
+			}
+		}
+		schemaVersion, err := migrations.CurrentVersion(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := restore(sqlDB, schemaVersion, os.Args[2]); err != nil {
+			log.Fatal("Restore failed: ", err)
+		}
+
+	default:
+		fmt.Println(usage)
+		os.Exit(2)
+	}
+}
+
+// create writes the header and then every row, table by table, parents first
+func create(sqlDB *sql.DB, schemaVersion int, path string) error {
+	tables, err := database.Tables(sqlDB)
+	if err != nil {
+		return err
+	}
+
+	counts := make(map[string]int)
+	for _, table := range tables {
+		var count int
+		if err := sqlDB.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s", database.Quote(table))).Scan(&count); err != nil {
+			return fmt.Errorf("%s: %w", table, err)
+		}
+		counts[table] = count
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	out := bufio.NewWriter(file)
+	enc := json.NewEncoder(out)
+
+	err = enc.Encode(header{
+		Format:        archiveFormat,
+		Version:       archiveVersion,
+		SchemaVersion: schemaVersion,
+		CreatedAt:     time.Now(),
+		Tables:        counts,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, table := range tables {
+		written, err := writeTable(sqlDB, enc, table)
+		if err != nil {
+			return fmt.Errorf("%s: %w", table, err)
+		}
+		if written != counts[table] {
+			return fmt.Errorf("%s changed while backing up (%d rows counted, %d written)", table, counts[table], written)
+		}
+		fmt.Printf("%-28s %6d rows\n", table, written)
+	}
+
+	if err := out.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("Backup written to %s (schema version %d)\n", path, schemaVersion)
+	return file.Close()
+}
+
+func writeTable(sqlDB *sql.DB, enc *json.Encoder, table string) (int, error) {
+	columns, err := database.Columns(sqlDB, table)
+	if err != nil {
+		return 0, err
+	}
+	names := make([]string, len(columns))
+	orderBy := "rowid"
+	for i, c := range columns {
+		names[i] = c.Name
+		if c.PrimaryKey {
+			orderBy = database.Quote(c.Name)
+		}
+	}
+
+	rows, err := sqlDB.Query(fmt.Sprintf("SELECT %s FROM %s ORDER BY %s", database.QuoteList(names), database.Quote(table), orderBy))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	written := 0
+	for rows.Next() {
+		values := make([]interface{}, len(names))
+		pointers := make([]interface{}, len(names))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return written, err
+		}
+
+		row := make(map[string]interface{}, len(names))
+		for i, name := range names {
+			row[name] = database.NormalizeValue(values[i])
+		}
+		if err := enc.Encode(record{Table: table, Row: row}); err != nil {
+			return written, err
+		}
+		written++
+	}
+	return written, rows.Err()
+}
+
+// restore checks the archive against the database and inserts every row in
+// one DB transaction, so a failed restore leaves the database empty
+func restore(sqlDB *sql.DB, schemaVersion int, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(file))
+	dec.UseNumber()
+
+	var head header
+	if err := dec.Decode(&head); err != nil {
+		return fmt.Errorf("reading header: %w", err)
+	}
+	if head.Format != archiveFormat {
+		return fmt.Errorf("%s is not a backup archive", path)
+	}
+	if head.Version != archiveVersion {
+		return fmt.Errorf("unsupported archive version %d", head.Version)
+	}
+	if head.SchemaVersion != schemaVersion {
+		return fmt.Errorf("archive has schema version %d but the database is at %d, restore with a build at the same migration", head.SchemaVersion, schemaVersion)
+	}
+
+	tables, err := database.Tables(sqlDB)
+	if err != nil {
+		return err
+	}
+	columns := make(map[string]map[string]bool)
+	for _, table := range tables {
+		var count int
+		if err := sqlDB.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s", database.Quote(table))).Scan(&count); err != nil {
+			return err
+		}
+		if count > 0 {
+			return fmt.Errorf("database is not empty (%s has %d rows), restore only into an empty database", table, count)
+		}
+		cols, err := database.Columns(sqlDB, table)
+		if err != nil {
+			return err
+		}
+		columns[table] = make(map[string]bool)
+		for _, c := range cols {
+			columns[table][c.Name] = true
+		}
+	}
+	for table := range head.Tables {
+		if columns[table] == nil {
+			return fmt.Errorf("archive contains table %s which the database doesn't have", table)
+		}
+	}
+
+	tx, err := sqlDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	restored := make(map[string]int)
+	for {
+		var rec record
+		if err := dec.Decode(&rec); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return fmt.Errorf("reading row: %w", err)
+		}
+		if columns[rec.Table] == nil {
+			return fmt.Errorf("row for unknown table %s", rec.Table)
+		}
+
+		names := make([]string, 0, len(rec.Row))
+		values := make([]interface{}, 0, len(rec.Row))
+		for name, value := range rec.Row {
+			if !columns[rec.Table][name] {
+				return fmt.Errorf("%s has no column %s", rec.Table, name)
+			}
+			names = append(names, name)
+			values = append(values, fromJSON(value))
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(names)), ",")
+		stmt := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", database.Quote(rec.Table), database.QuoteList(names), placeholders)
+		if _, err := tx.Exec(stmt, values...); err != nil {
+			return fmt.Errorf("%s: %w", rec.Table, err)
+		}
+		restored[rec.Table]++
+	}
+
+	for table, want := range head.Tables {
+		if restored[table] != want {
+			return fmt.Errorf("archive is truncated: %s has %d of %d rows", table, restored[table], want)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, table := range tables {
+		fmt.Printf("%-28s %6d rows\n", table, restored[table])
+	}
+	fmt.Printf("Restored %s (taken %s)\n", path, head.CreatedAt.Format("2006-01-02 15:04"))
+	return nil
+}
+
+// fromJSON turns decoded numbers back into integers where possible, so ids
+// and amounts keep their exact value
+func fromJSON(v interface{}) interface{} {
+	n, ok := v.(json.Number)
+	if !ok {
+		return v
+	}
+	if i, err := n.Int64(); err == nil {
+		return i
+	}
+	f, _ := n.Float64()
+	return f
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"kbt-cuy/config"
+	database "kbt-cuy/db"
+	"kbt-cuy/migrations"
+	"log"
+	"os"
+	"strconv"
+)
+
+const usage = `Usage: go run ./cmd/migrate <command>
+
+Commands:
+  up          apply all pending migrations
+  down [n]    revert the last n migrations (default 1)
+  status      list migrations and whether they are applied
+
+To copy data between databases, use go run ./cmd/sync`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Println(usage)
+		os.Exit(2)
+	}
+
+	config.LoadConfig()
+
+	db, err := database.Open(config.DatabaseURL)
+	if err != nil {
+		log.Fatal("Failed to connect to database:", err)
+	}
+
+	switch os.Args[1] {
+	case "up":
+		applied, err := migrations.Up(db)
+		for _, m := range applied {
+			fmt.Printf("Applied  %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(applied) == 0 {
+			fmt.Println("Database is up to date.")
+		}
+
+	case "down":
+		n := 1
+		if len(os.Args) > 2 {
+			if n, err = strconv.Atoi(os.Args[2]); err != nil || n < 1 {
+				log.Fatal("down expects a positive number of migrations")
+			}
+		}
+		reverted, err := migrations.Down(db, n)
+		for _, m := range reverted {
+			fmt.Printf("Reverted %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+
+	case "status":
+		states, err := migrations.Status(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, s := range states {
+			if s.Applied {
+				fmt.Printf("[x] %04d_%s  (applied %s)\n", s.Version, s.Name, s.AppliedAt.Format("2006-01-02 15:04"))
+			} else {
+				fmt.Printf("[ ] %04d_%s\n", s.Version, s.Name)
+			}
+		}
+
+	default:
+		fmt.Println(usage)
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"kbt-cuy/config"
+	database "kbt-cuy/db"
+	"kbt-cuy/models"
+	"log"
+)
+
+// reconcile compares each station's PowerbankLeft counter with the Powerbank
+// rows actually docked there, and rewrites the counter when run with -fix.
+func main() {
+	fix := flag.Bool("fix", false, "rewrite drifted counters instead of only reporting them")
+	flag.Parse()
+
+	config.LoadConfig()
+
+	db, err := database.Open(config.DatabaseURL)
+	if err != nil {
+		log.Fatal("Failed to connect to database:", err)
+	}
+
+	var stations []models.PowerbankStation
+	if err := db.Scopes(models.WithStock).Order("id").Find(&stations).Error; err != nil {
+		log.Fatal("Failed to load stations:", err)
+	}
+
+	drifted := 0
+	for _, station := range stations {
+		status := "ok"
+		if station.PowerbankLeft != station.AvailableCount {
+			drifted++
+			status = "DRIFT"
+			if *fix {
+				if err := models.SyncStationStock(db, station.ID); err != nil {
+					log.Printf("Failed to fix station %d: %v", station.ID, err)
+					status = "DRIFT (fix failed)"
+				} else {
+					status = "fixed"
+				}
+			}
+		}
+		if station.DockedCount > station.Capacity {
+			status += ", over capacity"
+		}
+
+		fmt.Printf("#%-4d %-30s counter=%-3d available=%-3d docked=%d/%d  %s\n",
+			station.ID, station.Name, station.PowerbankLeft, station.AvailableCount,
+			station.DockedCount, station.Capacity, status)
+	}
+
+	fmt.Printf("%d station(s) checked, %d drifted\n", len(stations), drifted)
+	if drifted > 0 && !*fix {
+		fmt.Println("Run with -fix to rewrite the counters.")
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"kbt-cuy/config"
+	database "kbt-cuy/db"
+	"log"
+	"strings"
+)
+
+// tableResult counts what happened to the rows of one table
+type tableResult struct {
+	Table     string
+	Source    int
+	Inserted  int
+	Updated   int
+	Unchanged int
+	Extra     int // Rows only present in the destination, left untouched
+}
+
+// sync copies rows from one database to another, upserting by primary key.
+// Both databases must already be migrated to the same schema.
+func main() {
+	config.LoadConfig()
+
+	from := flag.String("from", "file:powerbank.db", "source database URL")
+	to := flag.String("to", config.DatabaseURL, "destination database URL (defaults to DATABASE_URL / TURSO_URL)")
+	only := flag.String("tables", "", "comma-separated tables to copy (default: all)")
+	dryRun := flag.Bool("dry-run", false, "only report the differences, write nothing")
+	batchSize := flag.Int("batch", 200, "rows written per transaction")
+	flag.Parse()
+
+	if *from == *to {
+		log.Fatal("Source and destination are the same database")
+	}
+
+	src := openSQL(*from)
+	defer src.Close()
+	dst := openSQL(*to)
+	defer dst.Close()
+
+	tables, err := database.Tables(src)
+	if err != nil {
+		log.Fatal("Failed to list source tables:", err)
+	}
+	if *only != "" {
+		tables = filterTables(tables, strings.Split(*only, ","))
+	}
+
+	mode := "Syncing"
+	if *dryRun {
+		mode = "Dry run"
+	}
+	fmt.Printf("%s %s -> %s\n\n", mode, database.Describe(*from), database.Describe(*to))
+	fmt.Printf("%-28s %8s %8s %8s %10s %8s\n", "TABLE", "SOURCE", "INSERT", "UPDATE", "UNCHANGED", "EXTRA")
+
+	failed := false
+	for _, table := range tables {
+		result, err := syncTable(src, dst, table, *dryRun, *batchSize)
+		if err != nil {
+			log.Printf("%s: %v", table, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("%-28s %8d %8d %8d %10d %8d\n",
+			result.Table, result.Source, result.Inserted, result.Updated, result.Unchanged, result.Extra)
+	}
+
+	if failed {
+		log.Fatal("Sync finished with errors")
+	}
+	if *dryRun {
+		fmt.Println("\nDry run, nothing was written.")
+	}
+}
+
+func openSQL(rawURL string) *sql.DB {
+	gormDB, err := database.Open(rawURL)
+	if err != nil {
+		log.Fatalf("Failed to open %s: %v", database.Describe(rawURL), err)
+	}
+	sqlDB, err := gormDB.DB()
+	if err != nil {
+		log.Fatalf("Failed to open %s: %v", database.Describe(rawURL), err)
+	}
+	return sqlDB
+}
+
+func filterTables(tables []string, wanted []string) []string {
+	keep := make(map[string]bool)
+	for _, name := range wanted {
+		keep[strings.TrimSpace(name)] = true
+	}
+	var filtered []string
+	for _, table := range tables {
+		if keep[table] {
+			filtered = append(filtered, table)
+		}
+	}
+	return filtered
+}
+
+// syncTable upserts every source row that is missing or different in the destination
+func syncTable(src, dst *sql.DB, table string, dryRun bool, batchSize int) (tableResult, error) {
+	result := tableResult{Table: table}
+
+	columns, key, err := sharedColumns(src, dst, table)
+	if err != nil {
+		return result, err
+	}
+
+	srcRows, err := readRows(src, table, columns, key)
+	if err != nil {
+		return result, fmt.Errorf("reading source: %w", err)
+	}
+	dstRows, err := readRows(dst, table, columns, key)
+	if err != nil {
+		return result, fmt.Errorf("reading destination: %w", err)
+	}
+	result.Source = len(srcRows.order)
+
+	var changed [][]interface{}
+	for _, id := range srcRows.order {
+		row := srcRows.byKey[id]
+		existing, ok := dstRows.byKey[id]
+		switch {
+		case !ok:
+			result.Inserted++
+			changed = append(changed, row)
+		case !sameRow(row, existing):
+			result.Updated++
+			changed = append(changed, row)
+		default:
+			result.Unchanged++
+		}
+	}
+	for id := range dstRows.byKey {
+		if _, ok := srcRows.byKey[id]; !ok {
+			result.Extra++
+		}
+	}
+
+	if dryRun || len(changed) == 0 {
+		return result, nil
+	}
+	return result, upsert(dst, table, columns, key, changed, batchSize)
+}
+
+// sharedColumns returns the columns present on both sides and the primary key column
+func sharedColumns(src, dst *sql.DB, table string) ([]string, string, error) {
+	srcColumns, err := database.Columns(src, table)
+	if err != nil {
+		return nil, "", err
+	}
+	dstColumns, err := database.Columns(dst, table)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(dstColumns) == 0 {
+		return nil, "", fmt.Errorf("table missing in destination, run `go run ./cmd/migrate up` against it first")
+	}
+
+	inDst := make(map[string]bool)
+	for _, c := range dstColumns {
+		inDst[c.Name] = true
+	}
+
+	var columns []string
+	key := ""
+	for _, c := range srcColumns {
+		if !inDst[c.Name] {
+			log.Printf("%s: column %s missing in destination, skipped", table, c.Name)
+			continue
+		}
+		columns = append(columns, c.Name)
+		if c.PrimaryKey {
+			key = c.Name
+		}
+	}
+	if key == "" {
+		return nil, "", fmt.Errorf("no single-column primary key")
+	}
+	return columns, key, nil
+}
+
+type tableRows struct {
+	order []string
+	byKey map[string][]interface{}
+}
+
+func readRows(sqlDB *sql.DB, table string, columns []string, key string) (tableRows, error) {
+	result := tableRows{byKey: make(map[string][]interface{})}
+
+	query := fmt.Sprintf("SELECT %s FROM %s ORDER BY %s", database.QuoteList(columns), database.Quote(table), database.Quote(key))
+	rows, err := sqlDB.Query(query)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	keyIndex := indexOf(columns, key)
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return result, err
+		}
+		for i := range values {
+			values[i] = database.NormalizeValue(values[i])
+		}
+		id := fmt.Sprint(values[keyIndex])
+		result.order = append(result.order, id)
+		result.byKey[id] = values
+	}
+	return result, rows.Err()
+}
+
+// upsert writes rows in batches, one DB transaction per batch, with
+// parameterized statements so values are never spliced into SQL
+func upsert(dst *sql.DB, table string, columns []string, key string, rows [][]interface{}, batchSize int) error {
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(columns)), ",")
+	var updates []string
+	for _, c := range columns {
+		if c != key {
+			updates = append(updates, fmt.Sprintf("%s = excluded.%s", database.Quote(c), database.Quote(c)))
+		}
+	}
+	stmt := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON CONFLICT(%s) DO UPDATE SET %s",
+		database.Quote(table), database.QuoteList(columns), placeholders, database.Quote(key), strings.Join(updates, ", "))
+
+	for start := 0; start < len(rows); start += batchSize {
+		end := start + batchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		tx, err := dst.Begin()
+		if err != nil {
+			return err
+		}
+		for _, row := range rows[start:end] {
+			if _, err := tx.Exec(stmt, row...); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("writing rows %d-%d: %w", start+1, end, err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("committing rows %d-%d: %w", start+1, end, err)
+		}
+	}
+	return nil
+}
+
+func sameRow(a, b []interface{}) bool {
+	for i := range a {
+		if fmt.Sprint(a[i]) != fmt.Sprint(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func indexOf(names []string, name string) int {
+	for i, n := range names {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
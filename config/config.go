@@ -3,6 +3,9 @@ package config
 import (
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/midtrans/midtrans-go"
@@ -11,10 +14,36 @@ import (
 )
 
 var (
-	MidtransCore *coreapi.Client
-	MidtransSnap *snap.Client
-	TursoURL     string
-	TursoToken   string
+	MidtransCore      *coreapi.Client
+	MidtransSnap      *snap.Client
+	MidtransServerKey string
+	TursoURL          string
+	TursoToken        string
+	DatabaseURL       string // See db.Open for the accepted forms
+
+	// Overdue rentals
+	RentalAllowance     time.Duration // How long a rental may last before late fees start
+	LostAfter           time.Duration // How long a rental may last before the unit is declared lost
+	OverdueScanInterval time.Duration
+
+	// AdminUsernames are given the admin role at startup while no account is admin
+	AdminUsernames []string
+
+	// StationOfflineAfter is how long a station may miss heartbeats before it is shown as offline
+	StationOfflineAfter time.Duration
+
+	// DispenseTimeout is how long a paid rental waits for its powerbank to be taken before it is refunded
+	DispenseTimeout time.Duration
+
+	// ReturnTimeout is how long an opened return slot waits for the powerbank before the return is cancelled
+	ReturnTimeout time.Duration
+
+	// Lifetime of the bearer tokens issued to API clients
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+
+	// LockCommandsPerMinute caps the console commands sent to one station
+	LockCommandsPerMinute int
 )
 
 func LoadConfig() {
@@ -35,10 +64,46 @@ func LoadConfig() {
 	c.New(serverKey, midtrans.Sandbox)
 	MidtransCore = &c
 
+	// Kept server-side only, used to verify webhook signatures
+	MidtransServerKey = serverKey
+
 	// This is not a secure way to expose client key to frontend.
 	// We are setting it to os env for the handler to pick it up.
 	os.Setenv("MIDTRANS_CLIENT_KEY_FRONTEND", clientKey)
 
 	TursoURL = os.Getenv("TURSO_URL")
 	TursoToken = os.Getenv("TURSO_AUTH_TOKEN")
+
+	// DATABASE_URL wins, otherwise fall back to the Turso settings
+	DatabaseURL = os.Getenv("DATABASE_URL")
+	if DatabaseURL == "" && TursoURL != "" {
+		DatabaseURL = TursoURL + "?authToken=" + TursoToken
+	}
+
+	RentalAllowance = time.Duration(intEnv("RENTAL_ALLOWANCE_HOURS", 24)) * time.Hour
+	LostAfter = time.Duration(intEnv("LOST_AFTER_HOURS", 72)) * time.Hour
+	OverdueScanInterval = time.Duration(intEnv("OVERDUE_SCAN_MINUTES", 15)) * time.Minute
+
+	StationOfflineAfter = time.Duration(intEnv("STATION_OFFLINE_SECONDS", 90)) * time.Second
+	LockCommandsPerMinute = intEnv("LOCK_COMMANDS_PER_MINUTE", 6)
+	DispenseTimeout = time.Duration(intEnv("DISPENSE_TIMEOUT_SECONDS", 120)) * time.Second
+	ReturnTimeout = time.Duration(intEnv("RETURN_TIMEOUT_SECONDS", 120)) * time.Second
+	AccessTokenTTL = time.Duration(intEnv("ACCESS_TOKEN_TTL_MINUTES", 60)) * time.Minute
+	RefreshTokenTTL = time.Duration(intEnv("REFRESH_TOKEN_TTL_DAYS", 30)) * 24 * time.Hour
+
+	AdminUsernames = nil
+	for _, name := range strings.Split(os.Getenv("ADMIN_USERNAMES"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			AdminUsernames = append(AdminUsernames, name)
+		}
+	}
+}
+
+// intEnv reads a positive whole number from the environment, falling back to def
+func intEnv(name string, def int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return def
+	}
+	return value
 }
@@ -0,0 +1,78 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+
+	_ "github.com/tursodatabase/libsql-client-go/libsql"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// Open connects to the database described by rawURL:
+//
+//	memory, :memory:           a fresh in-memory SQLite database
+//	file:powerbank.db, *.db    a local SQLite file
+//	libsql://…, https://…      a Turso database (authToken as a query parameter)
+func Open(rawURL string) (*gorm.DB, error) {
+	switch {
+	case rawURL == "":
+		return nil, fmt.Errorf("no database configured, set DATABASE_URL or TURSO_URL")
+
+	case IsMemory(rawURL):
+		// memdb is shared by every connection of the pool, unlike plain :memory:
+		return gorm.Open(sqlite.Open("file:/kbt-cuy?vfs=memdb&_busy_timeout=5000"), &gorm.Config{})
+
+	case isRemote(rawURL):
+		sqlDB, err := sql.Open("libsql", rawURL)
+		if err != nil {
+			return nil, err
+		}
+		return gorm.Open(sqlite.Dialector{Conn: sqlDB}, &gorm.Config{})
+
+	default:
+		return gorm.Open(sqlite.Open(filePath(rawURL)+"?_busy_timeout=5000"), &gorm.Config{})
+	}
+}
+
+// IsMemory reports whether rawURL points to an in-memory database, which
+// starts empty every time the process starts
+func IsMemory(rawURL string) bool {
+	switch rawURL {
+	case "memory", ":memory:", "sqlite::memory:", "file::memory:":
+		return true
+	}
+	return false
+}
+
+// Describe returns rawURL without credentials, for logging
+func Describe(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return rawURL
+	}
+	u.RawQuery = ""
+	u.User = nil
+	return u.String()
+}
+
+func isRemote(rawURL string) bool {
+	for _, scheme := range []string{"libsql://", "https://", "http://", "wss://", "ws://"} {
+		if strings.HasPrefix(rawURL, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// filePath strips the optional file: or sqlite:// prefix of a local database URL
+func filePath(rawURL string) string {
+	path := strings.TrimPrefix(rawURL, "sqlite://")
+	path = strings.TrimPrefix(path, "file:")
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	return path
+}
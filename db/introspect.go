@@ -0,0 +1,124 @@
+package db
+
+import (
+	"database/sql"
+	"sort"
+	"strings"
+	"time"
+)
+
+// tableOrder lists the application tables parents first, so rows can be
+// copied without breaking foreign keys. Unknown tables are appended after.
+var tableOrder = []string{
+	"users",
+	"powerbank_stations",
+	"powerbanks",
+	"station_slots",
+	"tariff_plans",
+	"transactions",
+	"transaction_status_changes",
+	"ledger_entries",
+	"lock_audit_logs",
+}
+
+// bookkeepingTables belong to the migrations package and are never copied
+var bookkeepingTables = map[string]bool{
+	"schema_migrations":      true,
+	"schema_migrations_lock": true,
+}
+
+// Column describes one column of a table
+type Column struct {
+	Name       string
+	PrimaryKey bool
+}
+
+// Tables returns the application tables of the database, parents first
+func Tables(sqlDB *sql.DB) ([]string, error) {
+	rows, err := sqlDB.Query("SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	present := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		if !bookkeepingTables[name] {
+			present[name] = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var tables []string
+	for _, name := range tableOrder {
+		if present[name] {
+			tables = append(tables, name)
+			delete(present, name)
+		}
+	}
+	var rest []string
+	for name := range present {
+		rest = append(rest, name)
+	}
+	sort.Strings(rest)
+	return append(tables, rest...), nil
+}
+
+// Columns returns the columns of a table in declaration order
+func Columns(sqlDB *sql.DB, table string) ([]Column, error) {
+	rows, err := sqlDB.Query("SELECT name, pk FROM pragma_table_info(?) ORDER BY cid", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns []Column
+	for rows.Next() {
+		var c Column
+		var pk int
+		if err := rows.Scan(&c.Name, &pk); err != nil {
+			return nil, err
+		}
+		c.PrimaryKey = pk > 0
+		columns = append(columns, c)
+	}
+	return columns, rows.Err()
+}
+
+// timeLayout is how GORM's SQLite dialect stores datetime columns
+const timeLayout = "2006-01-02 15:04:05.999999999-07:00"
+
+// NormalizeValue converts a scanned column value to a driver-independent
+// form: times become GORM's text layout and byte slices become strings.
+// Values from a local SQLite file and from Turso can then be compared and
+// passed as statement parameters to either side.
+func NormalizeValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case time.Time:
+		return value.Format(timeLayout)
+	case []byte:
+		return string(value)
+	default:
+		return value
+	}
+}
+
+// Quote quotes a table or column name for use in SQL
+func Quote(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+// QuoteList quotes names and joins them with commas
+func QuoteList(names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = Quote(name)
+	}
+	return strings.Join(quoted, ",")
+}
@@ -0,0 +1,64 @@
+package esp32
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReplayGuardVerify(t *testing.T) {
+	const secret = "device-secret"
+	message := CommandMessage(7, "open", 2)
+	now := time.Now()
+
+	forged := Sign(secret, message, now)
+	forged.Value = Sign(secret, CommandMessage(7, "open", 3), now).Value
+
+	tests := []struct {
+		name   string
+		secret string
+		sig    Signature
+		want   error
+	}{
+		{"valid command", secret, Sign(secret, message, now), nil},
+		{"forged value", secret, forged, ErrBadSignature},
+		{"other secret", secret, Sign("another-secret", message, now), ErrBadSignature},
+		{"signed too long ago", secret, Sign(secret, message, now.Add(-31*time.Second)), ErrExpired},
+		{"signed in the future", secret, Sign(secret, message, now.Add(31*time.Second)), ErrExpired},
+		{"no secret", "", Sign("", message, now), ErrNoSecret},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			guard := NewReplayGuard(30 * time.Second)
+			if err := guard.Verify(tt.secret, message, tt.sig, now); !errors.Is(err, tt.want) {
+				t.Errorf("Verify = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplayGuardRejectsReusedNonce(t *testing.T) {
+	const secret = "device-secret"
+	guard := NewReplayGuard(30 * time.Second)
+	message := CommandMessage(7, "open", 2)
+	now := time.Now()
+
+	sig := Sign(secret, message, now)
+	if err := guard.Verify(secret, message, sig, now); err != nil {
+		t.Fatalf("first Verify = %v", err)
+	}
+	if err := guard.Verify(secret, message, sig, now.Add(time.Second)); !errors.Is(err, ErrReplayed) {
+		t.Errorf("second Verify = %v, want %v", err, ErrReplayed)
+	}
+
+	// A rejected signature doesn't use up its nonce
+	other := Sign(secret, message, now)
+	tampered := other
+	tampered.Value = sig.Value
+	if err := guard.Verify(secret, message, tampered, now); !errors.Is(err, ErrBadSignature) {
+		t.Fatalf("tampered Verify = %v, want %v", err, ErrBadSignature)
+	}
+	if err := guard.Verify(secret, message, other, now); err != nil {
+		t.Errorf("Verify after a rejected attempt = %v", err)
+	}
+}
@@ -0,0 +1,37 @@
+package esp32
+
+import "time"
+
+// Slot events a cabinet reports on its own, outside of a command
+const (
+	EventRemoved  = "removed"  // A powerbank was taken out of the slot
+	EventInserted = "inserted" // A powerbank was pushed into the slot
+)
+
+// Event is something a cabinet observed at one of its slots
+type Event struct {
+	StationID     uint
+	Kind          string // EventRemoved or EventInserted
+	Slot          int
+	PowerbankCode string // Read by the slot's RFID reader, empty if the cabinet has none
+	At            time.Time
+}
+
+// EventHandler receives the events of every station, whatever driver they use
+type EventHandler func(Event)
+
+// NewEvent builds an event a station reported at the given Unix time. A
+// missing or future time is replaced by now.
+func NewEvent(stationID uint, kind string, slot int, code string, unix int64, now time.Time) Event {
+	at := now
+	if unix > 0 && unix <= now.Unix() {
+		at = time.Unix(unix, 0)
+	}
+	return Event{
+		StationID:     stationID,
+		Kind:          kind,
+		Slot:          slot,
+		PowerbankCode: code,
+		At:            at,
+	}
+}
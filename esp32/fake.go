@@ -0,0 +1,153 @@
+package esp32
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kbt-cuy/models"
+	"sync"
+	"time"
+)
+
+// FakeStation is an in-process station attached to a Hub without a network,
+// for tests and local development. It checks command signatures like the
+// firmware and acknowledges every command it accepts.
+type FakeStation struct {
+	Station models.PowerbankStation
+	Guard   *ReplayGuard
+
+	toHub   chan Message
+	fromHub chan Message
+	cancel  context.CancelFunc
+
+	mu       sync.Mutex
+	locks    map[int]LockStatus
+	commands []Command
+}
+
+// ConnectFake attaches a fake station to the hub and starts answering commands
+func ConnectFake(hub *Hub, station models.PowerbankStation) *FakeStation {
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &FakeStation{
+		Station: station,
+		Guard:   NewReplayGuard(30 * time.Second),
+		toHub:   make(chan Message, 16),
+		fromHub: make(chan Message, 16),
+		cancel:  cancel,
+		locks:   make(map[int]LockStatus),
+	}
+
+	go hub.Attach(ctx, station.ID, &fakeConn{f: f, ctx: ctx})
+	go f.run(ctx)
+
+	// Attach registers the connection asynchronously
+	for !hub.Connected(station.ID) {
+		time.Sleep(time.Millisecond)
+	}
+	return f
+}
+
+// Disconnect drops the fake station's connection
+func (f *FakeStation) Disconnect() {
+	f.cancel()
+}
+
+// Lock returns the lock state of a slot as the station sees it
+func (f *FakeStation) Lock(slot int) LockStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if status, ok := f.locks[slot]; ok {
+		return status
+	}
+	return LockClosed
+}
+
+// Commands returns every command the station accepted, oldest first
+func (f *FakeStation) Commands() []Command {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Command(nil), f.commands...)
+}
+
+// Report sends a slot event to the hub, as if the cabinet saw it happen now
+func (f *FakeStation) Report(kind string, slot int, code string) {
+	f.toHub <- Message{Type: MessageEvent, Event: kind, Slot: slot, Powerbank: code, At: time.Now().Unix()}
+}
+
+func (f *FakeStation) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-f.fromHub:
+			if msg.Type != MessageCommand {
+				continue
+			}
+			f.toHub <- f.handle(msg)
+		}
+	}
+}
+
+// handle verifies and applies one command and builds its ack
+func (f *FakeStation) handle(msg Message) Message {
+	ack := Message{Type: MessageAck, ID: msg.ID}
+
+	sig := Signature{Timestamp: msg.Timestamp, Nonce: msg.Nonce, Value: msg.Sig}
+	if err := f.Guard.Verify(f.Station.DeviceSecret, CommandMessage(f.Station.ID, msg.Action, msg.Slot), sig, time.Now()); err != nil {
+		fmt.Printf("[FAKE] Station %d rejected %s slot %d: %v\n", f.Station.ID, msg.Action, msg.Slot, err)
+		ack.Error = err.Error()
+		return ack
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch msg.Action {
+	case "open":
+		f.locks[msg.Slot] = LockOpen
+	case "close":
+		f.locks[msg.Slot] = LockClosed
+	}
+	f.commands = append(f.commands, Command{StationID: f.Station.ID, Slot: msg.Slot, Action: msg.Action, At: time.Now()})
+
+	ack.OK = true
+	ack.Lock = LockClosed
+	if status, ok := f.locks[msg.Slot]; ok {
+		ack.Lock = status
+	}
+	return ack
+}
+
+// fakeConn is the hub's end of a FakeStation connection
+type fakeConn struct {
+	f   *FakeStation
+	ctx context.Context
+}
+
+var errFakeClosed = errors.New("fake station disconnected")
+
+func (c *fakeConn) Read(ctx context.Context) (Message, error) {
+	select {
+	case msg := <-c.f.toHub:
+		return msg, nil
+	case <-c.ctx.Done():
+		return Message{}, errFakeClosed
+	case <-ctx.Done():
+		return Message{}, ctx.Err()
+	}
+}
+
+func (c *fakeConn) Write(ctx context.Context, msg Message) error {
+	select {
+	case c.f.fromHub <- msg:
+		return nil
+	case <-c.ctx.Done():
+		return errFakeClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *fakeConn) Close() error {
+	c.f.cancel()
+	return nil
+}
@@ -0,0 +1,83 @@
+package esp32
+
+import (
+	"encoding/json"
+	"fmt"
+	"kbt-cuy/models"
+	"net/http"
+	"time"
+)
+
+// HTTPDriver talks to the web server running on the ESP32 firmware. Commands
+// are signed with the station's DeviceSecret, see Sign and CommandMessage.
+type HTTPDriver struct {
+	Client *http.Client
+}
+
+// NewHTTPDriver creates a driver with a short timeout so the backend
+// doesn't hang if the ESP is offline
+func NewHTTPDriver() *HTTPDriver {
+	return &HTTPDriver{
+		Client: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// Open sends GET http://<ip>/open?slot=<n>
+func (d *HTTPDriver) Open(station models.PowerbankStation, slot int) error {
+	return d.command(station, "open", slot)
+}
+
+// Close sends GET http://<ip>/close?slot=<n>
+func (d *HTTPDriver) Close(station models.PowerbankStation, slot int) error {
+	return d.command(station, "close", slot)
+}
+
+// Status sends GET http://<ip>/status?slot=<n> and reads {"lock": "open"|"closed"}
+func (d *HTTPDriver) Status(station models.PowerbankStation, slot int) (LockStatus, error) {
+	resp, err := d.get(station, "status", slot)
+	if err != nil {
+		return LockUnknown, err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Lock LockStatus `json:"lock"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return LockUnknown, fmt.Errorf("invalid status response: %w", err)
+	}
+	return body.Lock, nil
+}
+
+func (d *HTTPDriver) command(station models.PowerbankStation, action string, slot int) error {
+	resp, err := d.get(station, action, slot)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (d *HTTPDriver) get(station models.PowerbankStation, action string, slot int) (*http.Response, error) {
+	if station.DeviceSecret == "" {
+		return nil, ErrNoSecret
+	}
+	sig := Sign(station.DeviceSecret, CommandMessage(station.ID, action, slot), time.Now())
+
+	// Construct URL: http://192.168.1.105/open?slot=3&ts=...&nonce=...&sig=...
+	url := fmt.Sprintf("http://%s/%s?slot=%d&ts=%d&nonce=%s&sig=%s",
+		station.IPAddress, action, slot, sig.Timestamp, sig.Nonce, sig.Value)
+	fmt.Printf("[HARDWARE] Sending Request: http://%s/%s?slot=%d (signed)\n", station.IPAddress, action, slot)
+
+	resp, err := d.Client.Get(url)
+	if err != nil {
+		fmt.Printf("[HARDWARE] Connection Failed: %v\n", err)
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("station returned error status: %s", resp.Status)
+	}
+	return resp, nil
+}
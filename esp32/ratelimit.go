@@ -0,0 +1,45 @@
+package esp32
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter caps how many manual commands a station receives in a
+// sliding window, so a stuck button or script can't hammer the cabinet
+type RateLimiter struct {
+	Limit  int
+	Window time.Duration
+
+	mu   sync.Mutex
+	sent map[uint][]time.Time
+}
+
+// NewRateLimiter allows limit commands per station in every window
+func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
+	return &RateLimiter{
+		Limit:  limit,
+		Window: window,
+		sent:   make(map[uint][]time.Time),
+	}
+}
+
+// Allow records a command for the station and reports whether it is within the limit
+func (l *RateLimiter) Allow(stationID uint) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	recent := l.sent[stationID][:0]
+	for _, at := range l.sent[stationID] {
+		if now.Sub(at) < l.Window {
+			recent = append(recent, at)
+		}
+	}
+	if len(recent) >= l.Limit {
+		l.sent[stationID] = recent
+		return false
+	}
+	l.sent[stationID] = append(recent, now)
+	return true
+}
@@ -1,58 +1,56 @@
 package esp32
 
 import (
-	"fmt"
-	"net/http"
-	"time"
+	"kbt-cuy/models"
+	"sync"
 )
 
-// TriggerLock sends a command to the ESP32 to open the lock
-func TriggerLock(stationIP string, action string) error {
-	// SIMULATION MODE
-	// If using the demo IP from seed data, we just print to console
-	if stationIP == "192.168.1.50" {
-		fmt.Printf("[SIMULATION] Connecting to %s...\n", stationIP)
-		time.Sleep(500 * time.Millisecond) // Simulate network latency
-
-		if action == "open" {
-			fmt.Printf("[SIMULATION] Command: OPEN LOCK. Holding for 10 seconds.\n")
-
-			// Simulate the hardware timer logic in the background
-			go func() {
-				time.Sleep(10 * time.Second)
-				fmt.Printf("[SIMULATION] Auto-Closing lock at %s\n", stationIP)
-			}()
-			return nil
-		}
-		return fmt.Errorf("unknown command")
-	}
-
-	// REAL HARDWARE IMPLEMENTATION
-	// This sends a real HTTP GET request to the ESP32's web server
+// LockStatus is the state of a station lock as reported by its driver
+type LockStatus string
 
-	client := http.Client{
-		Timeout: 5 * time.Second, // Don't hang the backend if ESP is offline
-	}
+const (
+	LockOpen    LockStatus = "open"
+	LockClosed  LockStatus = "closed"
+	LockUnknown LockStatus = "unknown"
+)
 
-	// Construct URL: http://192.168.1.105/open
-	url := fmt.Sprintf("http://%s/%s", stationIP, action)
-	fmt.Printf("[HARDWARE] Sending Request: %s\n", url)
+// LockDriver controls the slot locks of a station cabinet. Slots are
+// addressed by their 1-based StationSlot.Index.
+type LockDriver interface {
+	Open(station models.PowerbankStation, slot int) error
+	Close(station models.PowerbankStation, slot int) error
+	Status(station models.PowerbankStation, slot int) (LockStatus, error)
+}
 
-	resp, err := client.Get(url)
-	if err != nil {
-		fmt.Printf("[HARDWARE] Connection Failed: %v\n", err)
-		return err
-	}
-	defer resp.Body.Close()
+// Registry picks the LockDriver configured for each station
+type Registry struct {
+	mu       sync.RWMutex
+	drivers  map[string]LockDriver
+	fallback string
+}
 
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("station returned error status: %s", resp.Status)
+// NewRegistry creates an empty registry. Stations whose driver name is
+// empty or unknown are served by the driver registered under fallback.
+func NewRegistry(fallback string) *Registry {
+	return &Registry{
+		drivers:  make(map[string]LockDriver),
+		fallback: fallback,
 	}
+}
 
-	return nil
+// Register makes a driver available under the given name
+func (r *Registry) Register(name string, driver LockDriver) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.drivers[name] = driver
 }
 
-// RetryOpen allows the user to trigger the lock one more time
-func RetryOpen(stationIP string) error {
-	return TriggerLock(stationIP, "open")
+// For returns the driver selected by the station's LockDriver field
+func (r *Registry) For(station models.PowerbankStation) LockDriver {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if driver, ok := r.drivers[station.LockDriver]; ok {
+		return driver
+	}
+	return r.drivers[r.fallback]
 }
@@ -0,0 +1,143 @@
+package esp32
+
+import (
+	"fmt"
+	"kbt-cuy/models"
+	"sync"
+	"time"
+)
+
+// Command is a lock command received by the Simulator
+type Command struct {
+	StationID uint
+	Slot      int
+	Action    string
+	At        time.Time
+}
+
+// slotKey identifies one slot lock across all simulated stations
+type slotKey struct {
+	stationID uint
+	slot      int
+}
+
+// Simulator is an in-memory LockDriver for demos and tests. Locks open on
+// command and close again on their own after HoldFor, like the firmware.
+// ActAfter an open, a simulated user does what Expect says is due at the
+// slot, taking a powerbank out or pushing one in, and the cabinet reports
+// it to Events.
+// Every command is signed and then checked by Receive exactly as the
+// firmware would, using the station's DeviceSecret as the flashed secret.
+type Simulator struct {
+	Latency  time.Duration
+	HoldFor  time.Duration
+	ActAfter time.Duration
+	Guard    *ReplayGuard
+	Events   EventHandler
+	Expect   func(stationID uint, slot int) (kind, code string) // Empty kind if nothing is due
+
+	mu       sync.Mutex
+	locks    map[slotKey]LockStatus
+	commands []Command
+}
+
+// NewSimulator creates a simulator that mimics the real hardware timings
+func NewSimulator() *Simulator {
+	return &Simulator{
+		Latency:  500 * time.Millisecond,
+		HoldFor:  10 * time.Second,
+		ActAfter: 3 * time.Second,
+		Guard:    NewReplayGuard(30 * time.Second),
+		locks:    make(map[slotKey]LockStatus),
+	}
+}
+
+// Open unlocks the slot and schedules the auto-close
+func (s *Simulator) Open(station models.PowerbankStation, slot int) error {
+	if err := s.send(station, "open", slot); err != nil {
+		return err
+	}
+	fmt.Printf("[SIMULATION] Command: OPEN LOCK at %s slot %d. Holding for %s.\n", station.Name, slot, s.HoldFor)
+	s.setLock(station.ID, slot, LockOpen)
+
+	// Simulate the hardware timer logic in the background
+	if s.HoldFor > 0 {
+		go func() {
+			time.Sleep(s.HoldFor)
+			fmt.Printf("[SIMULATION] Auto-Closing lock at %s slot %d\n", station.Name, slot)
+			s.setLock(station.ID, slot, LockClosed)
+		}()
+	}
+	if s.Events != nil && s.Expect != nil && s.ActAfter > 0 {
+		go func() {
+			time.Sleep(s.ActAfter)
+			kind, code := s.Expect(station.ID, slot)
+			if kind == "" {
+				return
+			}
+			fmt.Printf("[SIMULATION] Powerbank %s %s at %s slot %d\n", code, kind, station.Name, slot)
+			s.Events(Event{StationID: station.ID, Kind: kind, Slot: slot, PowerbankCode: code, At: time.Now()})
+		}()
+	}
+	return nil
+}
+
+// Close locks the slot immediately
+func (s *Simulator) Close(station models.PowerbankStation, slot int) error {
+	if err := s.send(station, "close", slot); err != nil {
+		return err
+	}
+	fmt.Printf("[SIMULATION] Command: CLOSE LOCK at %s slot %d.\n", station.Name, slot)
+	s.setLock(station.ID, slot, LockClosed)
+	return nil
+}
+
+// Status reports the simulated lock state of the slot
+func (s *Simulator) Status(station models.PowerbankStation, slot int) (LockStatus, error) {
+	if err := s.send(station, "status", slot); err != nil {
+		return LockUnknown, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if status, ok := s.locks[slotKey{station.ID, slot}]; ok {
+		return status, nil
+	}
+	return LockClosed, nil
+}
+
+// Receive is the firmware side of a command: it rejects unsigned, forged,
+// stale and replayed commands and records the ones it accepts
+func (s *Simulator) Receive(station models.PowerbankStation, action string, slot int, sig Signature) error {
+	time.Sleep(s.Latency) // Simulate network latency
+
+	if err := s.Guard.Verify(station.DeviceSecret, CommandMessage(station.ID, action, slot), sig, time.Now()); err != nil {
+		fmt.Printf("[SIMULATION] Rejected %s at %s slot %d: %v\n", action, station.Name, slot, err)
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commands = append(s.commands, Command{StationID: station.ID, Slot: slot, Action: action, At: time.Now()})
+	return nil
+}
+
+// Commands returns every command received so far, oldest first
+func (s *Simulator) Commands() []Command {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Command(nil), s.commands...)
+}
+
+// send signs a command like the HTTP driver does and hands it to Receive
+func (s *Simulator) send(station models.PowerbankStation, action string, slot int) error {
+	if station.DeviceSecret == "" {
+		return ErrNoSecret
+	}
+	return s.Receive(station, action, slot, Sign(station.DeviceSecret, CommandMessage(station.ID, action, slot), time.Now()))
+}
+
+func (s *Simulator) setLock(stationID uint, slot int, status LockStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.locks[slotKey{stationID, slot}] = status
+}
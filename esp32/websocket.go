@@ -0,0 +1,235 @@
+package esp32
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kbt-cuy/models"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+// ErrNotConnected is returned when a command is sent to a station that has
+// no open connection to the hub
+var ErrNotConnected = errors.New("station is not connected")
+
+// Message is one JSON frame exchanged with a station over its connection.
+// The server sends "command" frames, the station answers each with an "ack"
+// carrying the same ID and sends "event" frames when something happens at
+// a slot.
+type Message struct {
+	Type      string     `json:"type"`
+	ID        string     `json:"id"`
+	Action    string     `json:"action,omitempty"`
+	Slot      int        `json:"slot,omitempty"`
+	Timestamp int64      `json:"ts,omitempty"`
+	Nonce     string     `json:"nonce,omitempty"`
+	Sig       string     `json:"sig,omitempty"`
+	OK        bool       `json:"ok,omitempty"`
+	Lock      LockStatus `json:"lock,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	Event     string     `json:"event,omitempty"`
+	Powerbank string     `json:"powerbank,omitempty"`
+	At        int64      `json:"at,omitempty"`
+}
+
+// Message types
+const (
+	MessageCommand = "command"
+	MessageAck     = "ack"
+	MessageEvent   = "event"
+)
+
+// Conn is one station's connection to the Hub: a WebSocket in production,
+// a FakeStation in tests
+type Conn interface {
+	Read(ctx context.Context) (Message, error)
+	Write(ctx context.Context, msg Message) error
+	Close() error
+}
+
+// Hub is a LockDriver for stations that can't be reached by IP, e.g. behind
+// a campus NAT. The station dials out to the server and keeps the connection
+// open, and commands are pushed down it and acknowledged on the way back.
+type Hub struct {
+	Timeout time.Duration // How long to wait for an ack
+	Events  EventHandler  // Receives the slot events of connected stations
+
+	mu      sync.Mutex
+	conns   map[uint]Conn
+	pending map[string]chan Message
+}
+
+// NewHub creates a hub with the same timeout as the HTTP driver
+func NewHub() *Hub {
+	return &Hub{
+		Timeout: 5 * time.Second,
+		conns:   make(map[uint]Conn),
+		pending: make(map[string]chan Message),
+	}
+}
+
+// ServeWebSocket upgrades an already authenticated station request and
+// serves the connection until it drops
+func (h *Hub) ServeWebSocket(w http.ResponseWriter, r *http.Request, stationID uint) error {
+	ws, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		return err
+	}
+	return h.Attach(r.Context(), stationID, &wsConn{ws})
+}
+
+// Attach serves a station connection until it fails or ctx ends. A newer
+// connection from the same station replaces the old one.
+func (h *Hub) Attach(ctx context.Context, stationID uint, conn Conn) error {
+	h.mu.Lock()
+	if old, ok := h.conns[stationID]; ok {
+		old.Close()
+	}
+	h.conns[stationID] = conn
+	h.mu.Unlock()
+	fmt.Printf("[HUB] Station %d connected\n", stationID)
+
+	defer func() {
+		h.mu.Lock()
+		if h.conns[stationID] == conn {
+			delete(h.conns, stationID)
+		}
+		h.mu.Unlock()
+		conn.Close()
+		fmt.Printf("[HUB] Station %d disconnected\n", stationID)
+	}()
+
+	for {
+		msg, err := conn.Read(ctx)
+		if err != nil {
+			return err
+		}
+		switch msg.Type {
+		case MessageAck:
+			h.deliver(msg)
+		case MessageEvent:
+			if h.Events != nil {
+				h.Events(NewEvent(stationID, msg.Event, msg.Slot, msg.Powerbank, msg.At, time.Now()))
+			}
+		}
+	}
+}
+
+// Connected reports whether the station currently has a connection
+func (h *Hub) Connected(stationID uint) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, ok := h.conns[stationID]
+	return ok
+}
+
+// Open pushes a signed open command and waits for the ack
+func (h *Hub) Open(station models.PowerbankStation, slot int) error {
+	_, err := h.command(station, "open", slot)
+	return err
+}
+
+// Close pushes a signed close command and waits for the ack
+func (h *Hub) Close(station models.PowerbankStation, slot int) error {
+	_, err := h.command(station, "close", slot)
+	return err
+}
+
+// Status asks the station for the lock state of the slot
+func (h *Hub) Status(station models.PowerbankStation, slot int) (LockStatus, error) {
+	ack, err := h.command(station, "status", slot)
+	if err != nil {
+		return LockUnknown, err
+	}
+	return ack.Lock, nil
+}
+
+func (h *Hub) command(station models.PowerbankStation, action string, slot int) (Message, error) {
+	if station.DeviceSecret == "" {
+		return Message{}, ErrNoSecret
+	}
+
+	h.mu.Lock()
+	conn, ok := h.conns[station.ID]
+	h.mu.Unlock()
+	if !ok {
+		fmt.Printf("[HUB] Station %d is not connected, dropping %s slot %d\n", station.ID, action, slot)
+		return Message{}, ErrNotConnected
+	}
+
+	sig := Sign(station.DeviceSecret, CommandMessage(station.ID, action, slot), time.Now())
+	msg := Message{
+		Type:      MessageCommand,
+		ID:        sig.Nonce,
+		Action:    action,
+		Slot:      slot,
+		Timestamp: sig.Timestamp,
+		Nonce:     sig.Nonce,
+		Sig:       sig.Value,
+	}
+
+	acks := make(chan Message, 1)
+	h.mu.Lock()
+	h.pending[msg.ID] = acks
+	h.mu.Unlock()
+	defer func() {
+		h.mu.Lock()
+		delete(h.pending, msg.ID)
+		h.mu.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+	defer cancel()
+
+	fmt.Printf("[HUB] Sending %s slot %d to station %d\n", action, slot, station.ID)
+	if err := conn.Write(ctx, msg); err != nil {
+		return Message{}, err
+	}
+
+	select {
+	case ack := <-acks:
+		if !ack.OK {
+			return ack, fmt.Errorf("station rejected %s: %s", action, ack.Error)
+		}
+		return ack, nil
+	case <-ctx.Done():
+		return Message{}, fmt.Errorf("no ack from station %d for %s: %w", station.ID, action, ctx.Err())
+	}
+}
+
+func (h *Hub) deliver(ack Message) {
+	h.mu.Lock()
+	acks, ok := h.pending[ack.ID]
+	h.mu.Unlock()
+	if !ok {
+		return // Late ack for a command that already timed out
+	}
+	select {
+	case acks <- ack:
+	default:
+	}
+}
+
+// wsConn adapts a WebSocket to Conn, one JSON message per frame
+type wsConn struct {
+	ws *websocket.Conn
+}
+
+func (c *wsConn) Read(ctx context.Context) (Message, error) {
+	var msg Message
+	err := wsjson.Read(ctx, c.ws, &msg)
+	return msg, err
+}
+
+func (c *wsConn) Write(ctx context.Context, msg Message) error {
+	return wsjson.Write(ctx, c.ws, msg)
+}
+
+func (c *wsConn) Close() error {
+	return c.ws.Close(websocket.StatusNormalClosure, "")
+}
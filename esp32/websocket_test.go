@@ -0,0 +1,144 @@
+package esp32
+
+import (
+	"context"
+	"errors"
+	"kbt-cuy/models"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testStation() models.PowerbankStation {
+	station := models.PowerbankStation{Name: "Test", DeviceSecret: "device-secret"}
+	station.ID = 7
+	return station
+}
+
+// silentConn is a station that receives commands but never answers them
+type silentConn struct {
+	closed chan struct{}
+}
+
+func (c *silentConn) Read(ctx context.Context) (Message, error) {
+	select {
+	case <-c.closed:
+		return Message{}, errFakeClosed
+	case <-ctx.Done():
+		return Message{}, ctx.Err()
+	}
+}
+
+func (c *silentConn) Write(ctx context.Context, msg Message) error { return nil }
+
+func (c *silentConn) Close() error {
+	select {
+	case <-c.closed:
+	default:
+		close(c.closed)
+	}
+	return nil
+}
+
+func TestHubOpenIsAcknowledged(t *testing.T) {
+	hub := NewHub()
+	station := testStation()
+	fake := ConnectFake(hub, station)
+	defer fake.Disconnect()
+
+	if err := hub.Open(station, 2); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if got := fake.Lock(2); got != LockOpen {
+		t.Errorf("lock of slot 2 = %q, want %q", got, LockOpen)
+	}
+	status, err := hub.Status(station, 2)
+	if err != nil {
+		t.Fatalf("Status: %v", err)
+	}
+	if status != LockOpen {
+		t.Errorf("Status = %q, want %q", status, LockOpen)
+	}
+
+	commands := fake.Commands()
+	if len(commands) != 2 || commands[0].Action != "open" || commands[0].Slot != 2 {
+		t.Errorf("commands = %+v, want open slot 2 then status", commands)
+	}
+}
+
+func TestHubCommandTimesOut(t *testing.T) {
+	hub := NewHub()
+	hub.Timeout = 50 * time.Millisecond
+	station := testStation()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hub.Attach(ctx, station.ID, &silentConn{closed: make(chan struct{})})
+	for !hub.Connected(station.ID) {
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	err := hub.Open(station, 1)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Open = %v, want a deadline exceeded error", err)
+	}
+	if elapsed := time.Since(start); elapsed < hub.Timeout {
+		t.Errorf("Open returned after %v, before the %v timeout", elapsed, hub.Timeout)
+	}
+
+	hub.mu.Lock()
+	pending := len(hub.pending)
+	hub.mu.Unlock()
+	if pending != 0 {
+		t.Errorf("%d command(s) still waiting for an ack", pending)
+	}
+}
+
+func TestHubRejectsUnconnectedStation(t *testing.T) {
+	hub := NewHub()
+	if err := hub.Open(testStation(), 1); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("Open = %v, want %v", err, ErrNotConnected)
+	}
+}
+
+func TestHubCommandSignedWithWrongSecret(t *testing.T) {
+	hub := NewHub()
+	station := testStation()
+	fake := ConnectFake(hub, station)
+	defer fake.Disconnect()
+
+	station.DeviceSecret = "another-secret"
+	err := hub.Open(station, 1)
+	if err == nil || !strings.Contains(err.Error(), ErrBadSignature.Error()) {
+		t.Fatalf("Open = %v, want the station to reject the signature", err)
+	}
+	if got := fake.Lock(1); got != LockClosed {
+		t.Errorf("lock of slot 1 = %q, want %q", got, LockClosed)
+	}
+}
+
+func TestFakeStationRejectsBadSignature(t *testing.T) {
+	station := testStation()
+	fake := &FakeStation{Station: station, Guard: NewReplayGuard(30 * time.Second), locks: make(map[int]LockStatus)}
+
+	sig := Sign(station.DeviceSecret, CommandMessage(station.ID, "open", 3), time.Now())
+	msg := Message{Type: MessageCommand, ID: sig.Nonce, Action: "open", Slot: 3, Timestamp: sig.Timestamp, Nonce: sig.Nonce, Sig: sig.Value}
+
+	forged := msg
+	forged.Slot = 4 // Signed for slot 3
+	ack := fake.handle(forged)
+	if ack.OK || ack.Error != ErrBadSignature.Error() || ack.ID != msg.ID {
+		t.Errorf("ack of forged command = %+v, want a rejection with %q", ack, ErrBadSignature)
+	}
+	if len(fake.Commands()) != 0 || fake.Lock(4) != LockClosed {
+		t.Error("forged command was applied")
+	}
+
+	if ack := fake.handle(msg); !ack.OK || ack.Lock != LockOpen {
+		t.Errorf("ack of signed command = %+v, want ok with the slot open", ack)
+	}
+	if ack := fake.handle(msg); ack.OK || ack.Error != ErrReplayed.Error() {
+		t.Errorf("ack of replayed command = %+v, want a rejection with %q", ack, ErrReplayed)
+	}
+}
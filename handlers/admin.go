@@ -0,0 +1,577 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"kbt-cuy/models"
+	"kbt-cuy/pricing"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type AdminHandler struct {
+	DB      *gorm.DB
+	Pricing *pricing.Engine
+}
+
+// lockDrivers are the drivers a station can be set to in the station form
+var lockDrivers = []string{models.LockDriverHTTP, models.LockDriverWebSocket, models.LockDriverSimulator}
+
+// transactionStatuses are offered as filters on the transactions page
+var transactionStatuses = []models.TransactionStatus{
+	models.StatusPending, models.StatusPaid, models.StatusDispensing, models.StatusOngoing,
+	models.StatusReturning, models.StatusReturned, models.StatusFailed, models.StatusRefunded, models.StatusLost, models.StatusCancelled,
+}
+
+// Dashboard shows fleet totals and links to the admin pages
+func (h *AdminHandler) Dashboard(c *gin.Context) {
+	var stations, powerbanks, ongoing, lost, review int64
+	h.DB.Model(&models.PowerbankStation{}).Count(&stations)
+	h.DB.Model(&models.Powerbank{}).Count(&powerbanks)
+	h.DB.Model(&models.Transaction{}).Where("status = ?", models.StatusOngoing).Count(&ongoing)
+	h.DB.Model(&models.Powerbank{}).Where("status = ?", models.PowerbankLost).Count(&lost)
+	h.DB.Model(&models.Transaction{}).Where("review_note <> ''").Count(&review)
+
+	c.HTML(http.StatusOK, "admin_dashboard.html", gin.H{
+		"Stations":   stations,
+		"Powerbanks": powerbanks,
+		"Ongoing":    ongoing,
+		"Lost":       lost,
+		"Review":     review,
+		"IsLoggedIn": true,
+		"IsAdmin":    true,
+	})
+}
+
+// ListStations lists every station with its stock
+func (h *AdminHandler) ListStations(c *gin.Context) {
+	var stations []models.PowerbankStation
+	h.DB.Scopes(models.WithStock).Order("id").Find(&stations)
+
+	c.HTML(http.StatusOK, "admin_stations.html", gin.H{
+		"Stations":   stations,
+		"IsLoggedIn": true,
+		"IsAdmin":    true,
+	})
+}
+
+// NewStation shows an empty station form
+func (h *AdminHandler) NewStation(c *gin.Context) {
+	h.renderStationForm(c, http.StatusOK, models.PowerbankStation{Capacity: 8, LockDriver: models.LockDriverHTTP}, "")
+}
+
+// CreateStation saves a new station and creates its slots
+func (h *AdminHandler) CreateStation(c *gin.Context) {
+	var station models.PowerbankStation
+	if err := bindStation(c, &station); err != nil {
+		h.renderStationForm(c, http.StatusBadRequest, station, err.Error())
+		return
+	}
+
+	station.DeviceSecret = models.NewDeviceSecret()
+	if err := h.DB.Create(&station).Error; err != nil {
+		h.renderStationForm(c, http.StatusInternalServerError, station, "Failed to save station")
+		return
+	}
+	if err := models.EnsureSlots(h.DB); err != nil {
+		log.Printf("[ADMIN] Failed to create slots for station %d: %v", station.ID, err)
+	}
+
+	c.Redirect(http.StatusFound, "/admin/stations")
+}
+
+// EditStation shows the form for an existing station
+func (h *AdminHandler) EditStation(c *gin.Context) {
+	var station models.PowerbankStation
+	if err := h.DB.First(&station, c.Param("id")).Error; err != nil {
+		c.String(http.StatusNotFound, "Station not found")
+		return
+	}
+	h.renderStationForm(c, http.StatusOK, station, "")
+}
+
+// UpdateStation saves the station form. Lowering the capacity removes the
+// extra slots, which is refused while a powerbank is docked in one of them.
+func (h *AdminHandler) UpdateStation(c *gin.Context) {
+	var station models.PowerbankStation
+	if err := h.DB.First(&station, c.Param("id")).Error; err != nil {
+		c.String(http.StatusNotFound, "Station not found")
+		return
+	}
+
+	if err := bindStation(c, &station); err != nil {
+		h.renderStationForm(c, http.StatusBadRequest, station, err.Error())
+		return
+	}
+	if c.PostForm("regenerate_secret") != "" || station.DeviceSecret == "" {
+		station.DeviceSecret = models.NewDeviceSecret()
+	}
+
+	err := h.DB.Transaction(func(txDB *gorm.DB) error {
+		var occupied int64
+		if err := txDB.Model(&models.StationSlot{}).
+			Where("station_id = ? AND slot_index > ? AND powerbank_id IS NOT NULL", station.ID, station.Capacity).
+			Count(&occupied).Error; err != nil {
+			return err
+		}
+		if occupied > 0 {
+			return fmt.Errorf("%d powerbank(s) are docked in slots above %d, move them first", occupied, station.Capacity)
+		}
+
+		// Hard delete, so the slot index can be created again if the capacity grows back
+		if err := txDB.Unscoped().
+			Where("station_id = ? AND slot_index > ?", station.ID, station.Capacity).
+			Delete(&models.StationSlot{}).Error; err != nil {
+			return err
+		}
+		if err := txDB.Select("Name", "Latitude", "Longitude", "Capacity", "IPAddress", "LockDriver", "DeviceSecret").Save(&station).Error; err != nil {
+			return err
+		}
+		return models.SyncStationStock(txDB, station.ID)
+	})
+	if err != nil {
+		h.renderStationForm(c, http.StatusBadRequest, station, err.Error())
+		return
+	}
+	if err := models.EnsureSlots(h.DB); err != nil {
+		log.Printf("[ADMIN] Failed to create slots for station %d: %v", station.ID, err)
+	}
+
+	c.Redirect(http.StatusFound, "/admin/stations")
+}
+
+func (h *AdminHandler) renderStationForm(c *gin.Context, status int, station models.PowerbankStation, errMsg string) {
+	var plan models.TariffPlan
+	if station.ID != 0 {
+		plan, _ = h.Pricing.PlanFor(station.ID)
+	}
+	c.HTML(status, "admin_station_form.html", gin.H{
+		"Station":     station,
+		"Plan":        plan,
+		"Tariff":      pricing.Describe(plan),
+		"LockDrivers": lockDrivers,
+		"Error":       errMsg,
+		"IsLoggedIn":  true,
+		"IsAdmin":     true,
+	})
+}
+
+// bindStation copies the station form into station, keeping the raw input
+// on validation errors so the form can be shown again
+func bindStation(c *gin.Context, station *models.PowerbankStation) error {
+	station.Name = strings.TrimSpace(c.PostForm("name"))
+	station.IPAddress = strings.TrimSpace(c.PostForm("ip_address"))
+	station.LockDriver = c.PostForm("lock_driver")
+
+	lat, latErr := strconv.ParseFloat(c.PostForm("latitude"), 64)
+	lng, lngErr := strconv.ParseFloat(c.PostForm("longitude"), 64)
+	capacity, capErr := strconv.Atoi(c.PostForm("capacity"))
+	station.Latitude, station.Longitude, station.Capacity = lat, lng, capacity
+
+	switch {
+	case station.Name == "":
+		return errors.New("Name is required")
+	case latErr != nil || lat < -90 || lat > 90:
+		return errors.New("Latitude must be a number between -90 and 90")
+	case lngErr != nil || lng < -180 || lng > 180:
+		return errors.New("Longitude must be a number between -180 and 180")
+	case capErr != nil || capacity < 1 || capacity > 64:
+		return errors.New("Capacity must be between 1 and 64 slots")
+	case !slices.Contains(lockDrivers, station.LockDriver):
+		return errors.New("Unknown lock driver")
+	case station.LockDriver == models.LockDriverHTTP && station.IPAddress == "":
+		return errors.New("Stations using the http driver need a device address")
+	}
+	return nil
+}
+
+// tariffRow is a plan on the tariffs page with the station it overrides
+type tariffRow struct {
+	models.TariffPlan
+	StationName string
+	Tariff      string
+}
+
+// ListTariffs lists the default plans and the station overrides
+func (h *AdminHandler) ListTariffs(c *gin.Context) {
+	var plans []models.TariffPlan
+	h.DB.Order("station_id IS NOT NULL, is_default DESC, name").Find(&plans)
+
+	var stations []models.PowerbankStation
+	h.DB.Find(&stations)
+	names := make(map[uint]string, len(stations))
+	for _, station := range stations {
+		names[station.ID] = station.Name
+	}
+
+	rows := make([]tariffRow, 0, len(plans))
+	for _, plan := range plans {
+		row := tariffRow{TariffPlan: plan, Tariff: pricing.Describe(plan)}
+		if plan.StationID != nil {
+			row.StationName = names[*plan.StationID]
+		}
+		rows = append(rows, row)
+	}
+
+	c.HTML(http.StatusOK, "admin_tariffs.html", gin.H{
+		"Plans":      rows,
+		"IsLoggedIn": true,
+		"IsAdmin":    true,
+	})
+}
+
+// NewTariff shows an empty plan form, as an override if a station_id is given
+func (h *AdminHandler) NewTariff(c *gin.Context) {
+	plan := pricing.StandardPlan
+	plan.Name, plan.IsDefault = "", false
+	if id, err := strconv.ParseUint(c.Query("station_id"), 10, 32); err == nil {
+		sid := uint(id)
+		plan.StationID = &sid
+	}
+	h.renderTariffForm(c, http.StatusOK, plan, "")
+}
+
+// CreateTariff saves a new plan
+func (h *AdminHandler) CreateTariff(c *gin.Context) {
+	var plan models.TariffPlan
+	if err := h.bindTariff(c, &plan); err != nil {
+		h.renderTariffForm(c, http.StatusBadRequest, plan, err.Error())
+		return
+	}
+
+	if err := h.DB.Transaction(func(txDB *gorm.DB) error {
+		return saveTariff(txDB, &plan)
+	}); err != nil {
+		log.Printf("[ADMIN] Failed to save tariff %s: %v", plan.Name, err)
+		h.renderTariffForm(c, http.StatusInternalServerError, plan, "Failed to save tariff")
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/admin/tariffs")
+}
+
+// EditTariff shows the form for an existing plan
+func (h *AdminHandler) EditTariff(c *gin.Context) {
+	var plan models.TariffPlan
+	if err := h.DB.First(&plan, c.Param("id")).Error; err != nil {
+		c.String(http.StatusNotFound, "Tariff not found")
+		return
+	}
+	h.renderTariffForm(c, http.StatusOK, plan, "")
+}
+
+// UpdateTariff saves the plan form. Rentals keep the plan they were started
+// under, so the edited plan is saved as a new row and the old one is soft
+// deleted, where PlanForTransaction still finds it.
+func (h *AdminHandler) UpdateTariff(c *gin.Context) {
+	var plan models.TariffPlan
+	if err := h.DB.First(&plan, c.Param("id")).Error; err != nil {
+		c.String(http.StatusNotFound, "Tariff not found")
+		return
+	}
+
+	previous := plan.ID
+	if err := h.bindTariff(c, &plan); err != nil {
+		h.renderTariffForm(c, http.StatusBadRequest, plan, err.Error())
+		return
+	}
+
+	plan.Model = gorm.Model{}
+	err := h.DB.Transaction(func(txDB *gorm.DB) error {
+		if err := txDB.Delete(&models.TariffPlan{}, previous).Error; err != nil {
+			return err
+		}
+		return saveTariff(txDB, &plan)
+	})
+	if err != nil {
+		log.Printf("[ADMIN] Failed to save tariff %d: %v", previous, err)
+		plan.ID = previous
+		h.renderTariffForm(c, http.StatusInternalServerError, plan, "Failed to save tariff")
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/admin/tariffs")
+}
+
+// saveTariff creates the plan. A new default plan replaces the previous
+// default, a new override replaces the station's previous override.
+func saveTariff(txDB *gorm.DB, plan *models.TariffPlan) error {
+	if plan.IsDefault {
+		if err := txDB.Model(&models.TariffPlan{}).
+			Where("is_default = ? AND station_id IS NULL", true).
+			Update("is_default", false).Error; err != nil {
+			return err
+		}
+	}
+	if plan.StationID != nil {
+		if err := txDB.Where("station_id = ?", *plan.StationID).Delete(&models.TariffPlan{}).Error; err != nil {
+			return err
+		}
+	}
+	return txDB.Create(plan).Error
+}
+
+func (h *AdminHandler) renderTariffForm(c *gin.Context, status int, plan models.TariffPlan, errMsg string) {
+	var stations []models.PowerbankStation
+	h.DB.Order("name").Find(&stations)
+
+	var stationID uint
+	if plan.StationID != nil {
+		stationID = *plan.StationID
+	}
+	c.HTML(status, "admin_tariff_form.html", gin.H{
+		"Plan":       plan,
+		"StationID":  stationID,
+		"Stations":   stations,
+		"Error":      errMsg,
+		"IsLoggedIn": true,
+		"IsAdmin":    true,
+	})
+}
+
+// bindTariff copies the tariff form into plan, keeping the raw input on
+// validation errors so the form can be shown again
+func (h *AdminHandler) bindTariff(c *gin.Context, plan *models.TariffPlan) error {
+	plan.Name = strings.TrimSpace(c.PostForm("name"))
+	plan.IsDefault = c.PostForm("is_default") != ""
+
+	plan.StationID = nil
+	var stationErr error
+	if raw := c.PostForm("station_id"); raw != "" {
+		id, err := strconv.ParseUint(raw, 10, 32)
+		if err == nil {
+			err = h.DB.First(&models.PowerbankStation{}, id).Error
+		}
+		sid := uint(id)
+		plan.StationID, stationErr = &sid, err
+	}
+
+	amountsOK := true
+	amount := func(field string) int64 {
+		v, err := strconv.ParseInt(c.PostForm(field), 10, 64)
+		if err != nil || v < 0 {
+			amountsOK = false
+		}
+		return v
+	}
+	plan.UnlockFee = amount("unlock_fee")
+	plan.HourlyRate = amount("hourly_rate")
+	plan.DailyCap = amount("daily_cap")
+	plan.LateFeePerHour = amount("late_fee_per_hour")
+	plan.ForfeitFee = amount("forfeit_fee")
+
+	multiplier, multErr := strconv.ParseFloat(c.PostForm("peak_multiplier"), 64)
+	start, startErr := strconv.Atoi(c.PostForm("peak_start_hour"))
+	end, endErr := strconv.Atoi(c.PostForm("peak_end_hour"))
+	plan.PeakMultiplier, plan.PeakStartHour, plan.PeakEndHour = multiplier, start, end
+
+	switch {
+	case plan.Name == "":
+		return errors.New("Name is required")
+	case stationErr != nil:
+		return errors.New("Unknown station")
+	case plan.IsDefault && plan.StationID != nil:
+		return errors.New("A station override can't be the default plan")
+	case !amountsOK:
+		return errors.New("Amounts must be whole rupiah, 0 or more")
+	case plan.HourlyRate == 0:
+		return errors.New("The hourly rate must be more than 0")
+	case multErr != nil || multiplier < 1:
+		return errors.New("The peak multiplier must be 1 or more")
+	case startErr != nil || endErr != nil || start < 0 || start > 23 || end < 0 || end > 23:
+		return errors.New("Peak hours must be between 0 and 23")
+	}
+	return nil
+}
+
+// ListPowerbanks lists every unit with where it is docked
+func (h *AdminHandler) ListPowerbanks(c *gin.Context) {
+	h.renderPowerbanks(c, http.StatusOK, "", "")
+}
+
+// RegisterPowerbank adds a new unit and docks it in a free slot of the chosen station
+func (h *AdminHandler) RegisterPowerbank(c *gin.Context) {
+	code := strings.TrimSpace(c.PostForm("powerbank_code"))
+	capacity, err := strconv.Atoi(c.PostForm("capacity"))
+	if code == "" || err != nil || capacity <= 0 {
+		h.renderPowerbanks(c, http.StatusBadRequest, "A code and a capacity in mAh are required", "")
+		return
+	}
+	stationID, err := strconv.ParseUint(c.PostForm("station_id"), 10, 32)
+	if err != nil {
+		h.renderPowerbanks(c, http.StatusBadRequest, "Choose the station the powerbank is docked in", "")
+		return
+	}
+
+	err = h.DB.Transaction(func(txDB *gorm.DB) error {
+		sid := uint(stationID)
+		unit := models.Powerbank{PowerbankCode: code, Capacity: capacity, Status: models.PowerbankAvailable, CurrentStationID: &sid}
+		if err := txDB.Create(&unit).Error; err != nil {
+			return fmt.Errorf("Powerbank %s already exists", code)
+		}
+		if _, err := models.ReserveEmptySlot(txDB, sid, unit.ID); err != nil {
+			return errors.New("The station has no free slot")
+		}
+		return models.SyncStationStock(txDB, sid)
+	})
+	if err != nil {
+		h.renderPowerbanks(c, http.StatusBadRequest, err.Error(), "")
+		return
+	}
+
+	h.renderPowerbanks(c, http.StatusOK, "", fmt.Sprintf("Powerbank %s registered.", code))
+}
+
+func (h *AdminHandler) renderPowerbanks(c *gin.Context, status int, errMsg, message string) {
+	var powerbanks []models.Powerbank
+	h.DB.Preload("CurrentStation").Order("id").Find(&powerbanks)
+
+	var stations []models.PowerbankStation
+	h.DB.Scopes(models.WithStock, models.HasEmptySlot).Order("name").Find(&stations)
+
+	c.HTML(status, "admin_powerbanks.html", gin.H{
+		"Powerbanks": powerbanks,
+		"Stations":   stations,
+		"Error":      errMsg,
+		"Message":    message,
+		"IsLoggedIn": true,
+		"IsAdmin":    true,
+	})
+}
+
+// roles are offered on the users page
+var roles = []string{models.RoleUser, models.RoleOperator, models.RoleAdmin}
+
+// ListUsers lists every account with its role
+func (h *AdminHandler) ListUsers(c *gin.Context) {
+	h.renderUsers(c, http.StatusOK, "")
+}
+
+// UpdateUserRole changes the role of an account. Admins can't demote
+// themselves, so there is always someone left to undo a mistake.
+func (h *AdminHandler) UpdateUserRole(c *gin.Context) {
+	current := c.MustGet("user").(models.User)
+	role := c.PostForm("role")
+	if !slices.Contains(roles, role) {
+		h.renderUsers(c, http.StatusBadRequest, "Unknown role")
+		return
+	}
+
+	var user models.User
+	if err := h.DB.First(&user, c.Param("id")).Error; err != nil {
+		c.String(http.StatusNotFound, "User not found")
+		return
+	}
+	if user.ID == current.ID && role != models.RoleAdmin {
+		h.renderUsers(c, http.StatusBadRequest, "You can't remove your own admin role")
+		return
+	}
+
+	if err := h.DB.Model(&user).Update("role", role).Error; err != nil {
+		log.Printf("[ADMIN] Failed to set the role of %s to %s: %v", user.Username, role, err)
+		h.renderUsers(c, http.StatusInternalServerError, "Could not change the role of "+user.Username)
+		return
+	}
+	log.Printf("[ADMIN] %s set the role of %s to %s", current.Username, user.Username, role)
+	c.Redirect(http.StatusFound, "/admin/users")
+}
+
+func (h *AdminHandler) renderUsers(c *gin.Context, status int, errMsg string) {
+	var users []models.User
+	h.DB.Order("username").Find(&users)
+
+	c.HTML(status, "admin_users.html", gin.H{
+		"Users":      users,
+		"Roles":      roles,
+		"Error":      errMsg,
+		"IsLoggedIn": true,
+		"IsAdmin":    true,
+	})
+}
+
+// transactionFilter holds the query string of the transactions page
+type transactionFilter struct {
+	Status    string `form:"status"`
+	User      string `form:"user"`
+	StationID uint   `form:"station_id"`
+	From      string `form:"from"` // YYYY-MM-DD, in pricing.Location
+	To        string `form:"to"`
+	Review    bool   `form:"review"` // Only rentals flagged by a cabinet report
+}
+
+// ListTransactions shows the latest transactions matching the filters
+func (h *AdminHandler) ListTransactions(c *gin.Context) {
+	var filter transactionFilter
+	c.ShouldBindQuery(&filter)
+
+	query := h.DB.Model(&models.Transaction{})
+	if filter.Status != "" {
+		query = query.Where("transactions.status = ?", filter.Status)
+	}
+	if filter.User != "" {
+		query = query.Joins("JOIN users ON users.id = transactions.user_id").
+			Where("users.username LIKE ? OR users.email LIKE ?", "%"+filter.User+"%", "%"+filter.User+"%")
+	}
+	if filter.StationID != 0 {
+		query = query.Where("transactions.powerbank_station_origin_id = ? OR transactions.powerbank_station_return_id = ?", filter.StationID, filter.StationID)
+	}
+	if filter.Review {
+		query = query.Where("transactions.review_note <> ''")
+	}
+	if from, err := time.ParseInLocation("2006-01-02", filter.From, pricing.Location); err == nil {
+		query = query.Where("transactions.created_at >= ?", from)
+	}
+	if to, err := time.ParseInLocation("2006-01-02", filter.To, pricing.Location); err == nil {
+		query = query.Where("transactions.created_at < ?", to.AddDate(0, 0, 1))
+	}
+
+	var transactions []models.Transaction
+	query.Preload("User").
+		Preload("Powerbank").
+		Preload("PowerbankStationOrigin").
+		Preload("PowerbankStationReturn").
+		Order("transactions.created_at DESC").
+		Limit(200).
+		Find(&transactions)
+
+	var stations []models.PowerbankStation
+	h.DB.Order("name").Find(&stations)
+
+	c.HTML(http.StatusOK, "admin_transactions.html", gin.H{
+		"Transactions": transactions,
+		"Stations":     stations,
+		"Statuses":     transactionStatuses,
+		"Filter":       filter,
+		"IsLoggedIn":   true,
+		"IsAdmin":      true,
+	})
+}
+
+// OverdueRentals lists the rentals the overdue worker booked late fees for or declared lost
+func (h *AdminHandler) OverdueRentals(c *gin.Context) {
+	penalized := h.DB.Model(&models.LedgerEntry{}).
+		Select("transaction_id").
+		Where("kind IN ?", []string{models.LedgerLateFee, models.LedgerForfeit})
+
+	var transactions []models.Transaction
+	h.DB.Preload("User").
+		Preload("Powerbank").
+		Preload("PowerbankStationOrigin").
+		Preload("Ledger").
+		Where("id IN (?)", penalized).
+		Order("created_at DESC").
+		Find(&transactions)
+
+	c.HTML(http.StatusOK, "admin_overdue.html", gin.H{
+		"Transactions": transactions,
+		"IsLoggedIn":   true,
+		"IsAdmin":      true,
+	})
+}
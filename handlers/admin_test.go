@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"kbt-cuy/internal/testdb"
+	"kbt-cuy/models"
+	"kbt-cuy/pricing"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+func TestSaveTariffReplacesPreviousPlan(t *testing.T) {
+	db := testdb.Open(t)
+	station := models.PowerbankStation{Name: "Test", Capacity: 4}
+	if err := db.Create(&station).Error; err != nil {
+		t.Fatal(err)
+	}
+	engine := &pricing.Engine{DB: db}
+	save := func(plan models.TariffPlan) models.TariffPlan {
+		t.Helper()
+		if err := db.Transaction(func(txDB *gorm.DB) error { return saveTariff(txDB, &plan) }); err != nil {
+			t.Fatal(err)
+		}
+		return plan
+	}
+
+	oldDefault := save(models.TariffPlan{Name: "Old", IsDefault: true, HourlyRate: 1000})
+	newDefault := save(models.TariffPlan{Name: "New", IsDefault: true, HourlyRate: 2000})
+	db.First(&oldDefault, oldDefault.ID)
+	if oldDefault.IsDefault {
+		t.Error("previous default plan is still marked default")
+	}
+
+	oldOverride := save(models.TariffPlan{Name: "Override", StationID: &station.ID, HourlyRate: 3000})
+	rental := models.Transaction{PowerbankStationOriginID: station.ID, TariffPlanID: &oldOverride.ID}
+	newOverride := save(models.TariffPlan{Name: "Override", StationID: &station.ID, HourlyRate: 4000})
+
+	if plan, err := engine.PlanFor(station.ID); err != nil || plan.ID != newOverride.ID {
+		t.Errorf("PlanFor(station) = plan %d (%v), want the new override %d", plan.ID, err, newOverride.ID)
+	}
+	if plan, err := engine.PlanFor(station.ID + 1); err != nil || plan.ID != newDefault.ID {
+		t.Errorf("PlanFor(other station) = plan %d (%v), want the new default %d", plan.ID, err, newDefault.ID)
+	}
+	if plan, err := engine.PlanForTransaction(rental); err != nil || plan.HourlyRate != 3000 {
+		t.Errorf("running rental is priced at %d/hour (%v), want the 3000 it started with", plan.HourlyRate, err)
+	}
+}
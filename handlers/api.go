@@ -0,0 +1,486 @@
+package handlers
+
+import (
+	"errors"
+	"kbt-cuy/models"
+	"kbt-cuy/pricing"
+	"kbt-cuy/rental"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// APIHandler serves the JSON API under /api/v1 for the mobile app. Rentals
+// go through the same rental.Service as the HTML pages.
+type APIHandler struct {
+	DB      *gorm.DB
+	Pricing *pricing.Engine
+	Rentals *rental.Service
+}
+
+// Page size of list endpoints
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
+// Search radius of NearbyStations, in km
+const (
+	defaultNearbyRadiusKm = 5
+	maxNearbyRadiusKm     = 50
+)
+
+// apiPage is the window of a list response, sent as its "meta"
+type apiPage struct {
+	Limit  int   `json:"limit"`
+	Offset int   `json:"offset"`
+	Total  int64 `json:"total"`
+}
+
+type apiStation struct {
+	ID         uint     `json:"id"`
+	Name       string   `json:"name"`
+	Latitude   float64  `json:"latitude"`
+	Longitude  float64  `json:"longitude"`
+	Capacity   int      `json:"capacity"`
+	Available  int      `json:"available"`   // Powerbanks ready to rent
+	EmptySlots int      `json:"empty_slots"` // Slots free for a return
+	Online     bool     `json:"online"`
+	Tariff     string   `json:"tariff,omitempty"`      // Station detail only
+	Deposit    int64    `json:"deposit,omitempty"`     // Station detail only, paid up front in IDR
+	DistanceKm *float64 `json:"distance_km,omitempty"` // Nearby search only
+}
+
+type apiStationRef struct {
+	ID   uint   `json:"id"`
+	Name string `json:"name"`
+}
+
+type apiPayment struct {
+	Token       string `json:"token"` // Midtrans Snap token
+	RedirectURL string `json:"redirect_url"`
+}
+
+type apiRental struct {
+	ID               uint                     `json:"id"`
+	OrderID          string                   `json:"order_id"`
+	Status           models.TransactionStatus `json:"status"`
+	Powerbank        string                   `json:"powerbank,omitempty"`
+	OriginStation    apiStationRef            `json:"origin_station"`
+	OriginSlot       *int                     `json:"origin_slot"`
+	ReturnStation    *apiStationRef           `json:"return_station"`
+	ReturnSlot       *int                     `json:"return_slot"`
+	Deposit          int64                    `json:"deposit"`
+	FinalAmount      int64                    `json:"final_amount"`
+	CreatedAt        time.Time                `json:"created_at"`
+	DispenseDeadline *time.Time               `json:"dispense_deadline"`
+	RentedAt         *time.Time               `json:"rented_at"`
+	ReturnDeadline   *time.Time               `json:"return_deadline"`
+	ReturnedAt       *time.Time               `json:"returned_at"`
+	Payment          *apiPayment              `json:"payment,omitempty"` // Only while the deposit is unpaid
+}
+
+type apiLedgerEntry struct {
+	ID        uint      `json:"id"`
+	RentalID  uint      `json:"rental_id"`
+	Kind      string    `json:"kind"`
+	Amount    int64     `json:"amount"`
+	Status    string    `json:"status"`
+	Note      string    `json:"note"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type apiAccount struct {
+	ID           uint       `json:"id"`
+	Username     string     `json:"username"`
+	Email        string     `json:"email"`
+	Role         string     `json:"role"`
+	ActiveRental *apiRental `json:"active_rental"` // Being dispensed, rented or returned
+}
+
+// apiStationRequest is the body of the endpoints that act at a station
+type apiStationRequest struct {
+	StationID uint `json:"station_id" binding:"required"`
+}
+
+// APIError aborts the request with the error envelope of the JSON API,
+// {"error": {"code": "station_offline", "message": "..."}}
+func APIError(c *gin.Context, status int, code, message string) {
+	c.AbortWithStatusJSON(status, gin.H{"error": gin.H{"code": code, "message": message}})
+}
+
+// apiData answers with the success envelope {"data": ...}
+func apiData(c *gin.Context, status int, data interface{}) {
+	c.JSON(status, gin.H{"data": data})
+}
+
+// apiList answers with a page of a list, {"data": [...], "meta": {...}}
+func apiList(c *gin.Context, data interface{}, page apiPage) {
+	c.JSON(http.StatusOK, gin.H{"data": data, "meta": page})
+}
+
+// apiRentalError answers with the reason rental.Service refused a request
+func apiRentalError(c *gin.Context, err error, fallback string) {
+	status, code, message := rentalError(err, fallback)
+	if status == http.StatusInternalServerError {
+		log.Printf("[API] %s %s: %v", c.Request.Method, c.Request.URL.Path, err)
+	}
+	APIError(c, status, code, message)
+}
+
+// apiUserID returns the user authenticated by APIAuthRequired
+func apiUserID(c *gin.Context) uint {
+	return c.MustGet("user_id").(uint)
+}
+
+// parsePage reads the ?limit= and ?offset= of a list request
+func parsePage(c *gin.Context) (apiPage, bool) {
+	page := apiPage{Limit: defaultPageLimit}
+	var err error
+	if v := c.Query("limit"); v != "" {
+		if page.Limit, err = strconv.Atoi(v); err != nil || page.Limit < 1 || page.Limit > maxPageLimit {
+			APIError(c, http.StatusBadRequest, "invalid_parameter", "limit must be between 1 and "+strconv.Itoa(maxPageLimit))
+			return page, false
+		}
+	}
+	if v := c.Query("offset"); v != "" {
+		if page.Offset, err = strconv.Atoi(v); err != nil || page.Offset < 0 {
+			APIError(c, http.StatusBadRequest, "invalid_parameter", "offset must not be negative")
+			return page, false
+		}
+	}
+	return page, true
+}
+
+// paramID reads the numeric :id of the path, false if it can't be an ID
+func paramID(c *gin.Context) (uint, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	return uint(id), err == nil
+}
+
+// withRentalDetails preloads what toAPIRental needs
+func withRentalDetails(db *gorm.DB) *gorm.DB {
+	return db.Preload("Powerbank").Preload("PowerbankStationOrigin").Preload("PowerbankStationReturn")
+}
+
+func toAPIStation(station models.PowerbankStation) apiStation {
+	return apiStation{
+		ID:         station.ID,
+		Name:       station.Name,
+		Latitude:   station.Latitude,
+		Longitude:  station.Longitude,
+		Capacity:   station.Capacity,
+		Available:  station.AvailableCount,
+		EmptySlots: station.EmptySlots,
+		Online:     station.Online,
+	}
+}
+
+func toAPIRental(tx models.Transaction) apiRental {
+	data := apiRental{
+		ID:               tx.ID,
+		OrderID:          tx.OrderID,
+		Status:           tx.Status,
+		Powerbank:        tx.Powerbank.PowerbankCode,
+		OriginStation:    apiStationRef{ID: tx.PowerbankStationOriginID, Name: tx.PowerbankStationOrigin.Name},
+		OriginSlot:       tx.OriginSlotIndex,
+		ReturnSlot:       tx.ReturnSlotIndex,
+		Deposit:          tx.GrossAmount,
+		FinalAmount:      tx.FinalAmount,
+		CreatedAt:        tx.CreatedAt,
+		DispenseDeadline: tx.DispenseDeadline,
+		RentedAt:         tx.DateRented,
+		ReturnDeadline:   tx.ReturnDeadline,
+		ReturnedAt:       tx.DateReturned,
+	}
+	if tx.PowerbankStationReturn != nil {
+		data.ReturnStation = &apiStationRef{ID: tx.PowerbankStationReturn.ID, Name: tx.PowerbankStationReturn.Name}
+	}
+	if tx.Status == models.StatusPending {
+		data.Payment = &apiPayment{Token: tx.PaymentToken, RedirectURL: tx.PaymentRedirectURL}
+	}
+	return data
+}
+
+// ListStations returns every station with its stock
+func (h *APIHandler) ListStations(c *gin.Context) {
+	page, ok := parsePage(c)
+	if !ok {
+		return
+	}
+
+	var stations []models.PowerbankStation
+	h.DB.Model(&models.PowerbankStation{}).Count(&page.Total)
+	if err := h.DB.Scopes(models.WithStock).Order("id").
+		Limit(page.Limit).Offset(page.Offset).Find(&stations).Error; err != nil {
+		APIError(c, http.StatusInternalServerError, "internal_error", "Could not load stations")
+		return
+	}
+
+	data := make([]apiStation, 0, len(stations))
+	for _, station := range stations {
+		data = append(data, toAPIStation(station))
+	}
+	apiList(c, data, page)
+}
+
+// NearbyStations returns the stations within ?radius= km of ?lat= and ?lng=,
+// closest first. ?for=rent keeps stations with a powerbank ready to rent,
+// ?for=return those with a free slot.
+func (h *APIHandler) NearbyStations(c *gin.Context) {
+	lat, lng, ok := queryLocation(c)
+	if !ok {
+		APIError(c, http.StatusBadRequest, "invalid_parameter", "lat and lng must be valid coordinates")
+		return
+	}
+	radius := float64(defaultNearbyRadiusKm)
+	if v := c.Query("radius"); v != "" {
+		var err error
+		if radius, err = strconv.ParseFloat(v, 64); err != nil || radius <= 0 || radius > maxNearbyRadiusKm {
+			APIError(c, http.StatusBadRequest, "invalid_parameter", "radius must be more than 0 and at most "+strconv.Itoa(maxNearbyRadiusKm)+" km")
+			return
+		}
+	}
+	page, ok := parsePage(c)
+	if !ok {
+		return
+	}
+
+	query := h.DB.Scopes(models.WithStock, models.Near(lat, lng, radius))
+	switch c.Query("for") {
+	case "":
+	case "rent":
+		query = query.Scopes(models.HasAvailable)
+	case "return":
+		query = query.Scopes(models.HasEmptySlot)
+	default:
+		APIError(c, http.StatusBadRequest, "invalid_parameter", `for must be "rent" or "return"`)
+		return
+	}
+
+	var stations []models.PowerbankStation
+	if err := query.Find(&stations).Error; err != nil {
+		APIError(c, http.StatusInternalServerError, "internal_error", "Could not load stations")
+		return
+	}
+
+	// The box the query searched has corners outside the radius
+	nearby := models.ByDistance(stations, lat, lng)
+	within := 0
+	for within < len(nearby) && nearby[within].DistanceKm <= radius {
+		within++
+	}
+	page.Total = int64(within)
+	start := min(page.Offset, within)
+	end := min(start+page.Limit, within)
+
+	data := make([]apiStation, 0, end-start)
+	for _, station := range nearby[start:end] {
+		item := toAPIStation(station.PowerbankStation)
+		distance := math.Round(station.DistanceKm*1000) / 1000
+		item.DistanceKm = &distance
+		data = append(data, item)
+	}
+	apiList(c, data, page)
+}
+
+// GetStation returns a station with its tariff and the deposit a rental there takes
+func (h *APIHandler) GetStation(c *gin.Context) {
+	id, ok := paramID(c)
+	var station models.PowerbankStation
+	if !ok || h.DB.Scopes(models.WithStock).First(&station, id).Error != nil {
+		APIError(c, http.StatusNotFound, "station_not_found", "Station not found")
+		return
+	}
+
+	plan, err := h.Pricing.PlanFor(station.ID)
+	if err != nil {
+		APIError(c, http.StatusInternalServerError, "tariff_unavailable", "Could not load tariff")
+		return
+	}
+
+	data := toAPIStation(station)
+	data.Tariff = pricing.Describe(plan)
+	data.Deposit = pricing.Upfront(plan, time.Now())
+	apiData(c, http.StatusOK, data)
+}
+
+// CreateRental starts a rental at the station in the body. The rental stays
+// Pending until the deposit is paid with the returned Midtrans Snap token.
+func (h *APIHandler) CreateRental(c *gin.Context) {
+	var req apiStationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		APIError(c, http.StatusBadRequest, "invalid_request", "station_id is required")
+		return
+	}
+
+	transaction, err := h.Rentals.CreateOrder(apiUserID(c), req.StationID)
+	if err != nil {
+		status, code, message := orderError(err)
+		if status >= http.StatusInternalServerError && !errors.Is(err, rental.ErrStationOffline) {
+			log.Printf("[API] Order at station %d failed: %v", req.StationID, err)
+		}
+		APIError(c, status, code, message)
+		return
+	}
+
+	h.respondRental(c, http.StatusCreated, transaction.ID)
+}
+
+// ListRentals returns the user's rentals, newest first, optionally only
+// those with the ?status= given
+func (h *APIHandler) ListRentals(c *gin.Context) {
+	page, ok := parsePage(c)
+	if !ok {
+		return
+	}
+
+	query := h.DB.Model(&models.Transaction{}).Where("user_id = ?", apiUserID(c))
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	query = query.Session(&gorm.Session{})
+	query.Count(&page.Total)
+
+	var rentals []models.Transaction
+	if err := query.Scopes(withRentalDetails).Order("id DESC").
+		Limit(page.Limit).Offset(page.Offset).Find(&rentals).Error; err != nil {
+		APIError(c, http.StatusInternalServerError, "internal_error", "Could not load rentals")
+		return
+	}
+
+	data := make([]apiRental, 0, len(rentals))
+	for _, tx := range rentals {
+		data = append(data, toAPIRental(tx))
+	}
+	apiList(c, data, page)
+}
+
+// GetRental returns one of the user's rentals. While the deposit is unpaid,
+// Midtrans is asked for the payment status first, like the payment page does.
+func (h *APIHandler) GetRental(c *gin.Context) {
+	id, ok := paramID(c)
+	if !ok {
+		APIError(c, http.StatusNotFound, "rental_not_found", "Rental not found")
+		return
+	}
+
+	var transaction models.Transaction
+	if err := h.DB.Where("id = ? AND user_id = ?", id, apiUserID(c)).First(&transaction).Error; err != nil {
+		APIError(c, http.StatusNotFound, "rental_not_found", "Rental not found")
+		return
+	}
+	if transaction.Status == models.StatusPending && errors.Is(h.Rentals.SyncPayment(&transaction), rental.ErrAmountMismatch) {
+		APIError(c, http.StatusUnprocessableEntity, "payment_mismatch", "The payment does not match the deposit")
+		return
+	}
+
+	h.respondRental(c, http.StatusOK, transaction.ID)
+}
+
+// ReturnRental reserves a slot at the station in the body for the rental and
+// opens it. The rental is Returning until the cabinet detects the powerbank.
+func (h *APIHandler) ReturnRental(c *gin.Context) {
+	id, ok := paramID(c)
+	if !ok {
+		APIError(c, http.StatusNotFound, "rental_not_found", "Rental not found")
+		return
+	}
+	var req apiStationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		APIError(c, http.StatusBadRequest, "invalid_request", "station_id is required")
+		return
+	}
+
+	if _, err := h.Rentals.StartReturn(apiUserID(c), id, req.StationID); err != nil {
+		apiRentalError(c, err, "Could not start the return, please try again")
+		return
+	}
+	h.respondRental(c, http.StatusOK, id)
+}
+
+// ReopenRental opens the slot the rental is waiting on again
+func (h *APIHandler) ReopenRental(c *gin.Context) {
+	id, ok := paramID(c)
+	if !ok {
+		APIError(c, http.StatusNotFound, "rental_not_found", "Rental not found")
+		return
+	}
+
+	if _, err := h.Rentals.Reopen(apiUserID(c), id); err != nil {
+		apiRentalError(c, err, "Could not open the slot, please try again")
+		return
+	}
+	h.respondRental(c, http.StatusOK, id)
+}
+
+// respondRental answers with the rental as stored now
+func (h *APIHandler) respondRental(c *gin.Context, status int, id uint) {
+	var transaction models.Transaction
+	if err := h.DB.Scopes(withRentalDetails).First(&transaction, id).Error; err != nil {
+		APIError(c, http.StatusInternalServerError, "internal_error", "Could not load rental")
+		return
+	}
+	apiData(c, status, toAPIRental(transaction))
+}
+
+// Account returns the user's profile and the rental they have going, if any
+func (h *APIHandler) Account(c *gin.Context) {
+	var user models.User
+	if err := h.DB.First(&user, apiUserID(c)).Error; err != nil {
+		APIError(c, http.StatusNotFound, "user_not_found", "User not found")
+		return
+	}
+
+	account := apiAccount{ID: user.ID, Username: user.Username, Email: user.Email, Role: user.Role}
+	var active models.Transaction
+	if h.DB.Scopes(withRentalDetails).
+		Where("user_id = ? AND status IN ?", user.ID,
+			[]models.TransactionStatus{models.StatusDispensing, models.StatusOngoing, models.StatusReturning}).
+		Order("id DESC").Limit(1).Find(&active).RowsAffected == 1 {
+		data := toAPIRental(active)
+		account.ActiveRental = &data
+	}
+	apiData(c, http.StatusOK, account)
+}
+
+// History returns the money movements of the user's rentals, newest first:
+// deposits, charges, refunds and penalties
+func (h *APIHandler) History(c *gin.Context) {
+	page, ok := parsePage(c)
+	if !ok {
+		return
+	}
+
+	query := h.DB.Model(&models.LedgerEntry{}).
+		Joins("JOIN transactions ON transactions.id = ledger_entries.transaction_id").
+		Where("transactions.user_id = ?", apiUserID(c)).
+		Session(&gorm.Session{})
+	query.Count(&page.Total)
+
+	var entries []models.LedgerEntry
+	if err := query.Order("ledger_entries.id DESC").
+		Limit(page.Limit).Offset(page.Offset).Find(&entries).Error; err != nil {
+		APIError(c, http.StatusInternalServerError, "internal_error", "Could not load history")
+		return
+	}
+
+	data := make([]apiLedgerEntry, 0, len(entries))
+	for _, entry := range entries {
+		data = append(data, apiLedgerEntry{
+			ID:        entry.ID,
+			RentalID:  entry.TransactionID,
+			Kind:      entry.Kind,
+			Amount:    entry.Amount,
+			Status:    entry.Status,
+			Note:      entry.Note,
+			CreatedAt: entry.CreatedAt,
+		})
+	}
+	apiList(c, data, page)
+}
@@ -1,8 +1,12 @@
 package handlers
 
 import (
+	"errors"
+	"kbt-cuy/auth"
 	"kbt-cuy/models"
+	"log"
 	"net/http"
+	"time"
 
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
@@ -11,7 +15,18 @@ import (
 )
 
 type AuthHandler struct {
-	DB *gorm.DB
+	DB     *gorm.DB
+	Tokens *auth.Service
+}
+
+// tokenRequest is the body of POST /api/v1/auth/token. A client logs in
+// with grant_type "password" and later swaps its refresh token for a new
+// pair with grant_type "refresh_token".
+type tokenRequest struct {
+	GrantType    string `json:"grant_type" binding:"required"`
+	Username     string `json:"username"`
+	Password     string `json:"password"`
+	RefreshToken string `json:"refresh_token"`
 }
 
 func (h *AuthHandler) Register(c *gin.Context) {
@@ -25,6 +40,7 @@ func (h *AuthHandler) Register(c *gin.Context) {
 		Username: username,
 		Email:    email,
 		Password: string(hashedPassword),
+		Role:     models.RoleUser, // Staff roles are only given by an admin, see promoteAdmins
 	}
 
 	if result := h.DB.Create(&user); result.Error != nil {
@@ -36,25 +52,95 @@ func (h *AuthHandler) Register(c *gin.Context) {
 }
 
 func (h *AuthHandler) Login(c *gin.Context) {
-	username := c.PostForm("username")
-	password := c.PostForm("password")
+	user, ok := h.checkCredentials(c.PostForm("username"), c.PostForm("password"))
+	if !ok {
+		c.HTML(http.StatusUnauthorized, "login.html", gin.H{"Error": "Invalid credentials"})
+		return
+	}
 
+	session := sessions.Default(c)
+	session.Set("user_id", user.ID)
+	session.Save()
+
+	c.Redirect(http.StatusFound, "/account")
+}
+
+// checkCredentials returns the user if the password matches the stored bcrypt hash
+func (h *AuthHandler) checkCredentials(username, password string) (models.User, bool) {
 	var user models.User
 	if err := h.DB.Where("username = ?", username).First(&user).Error; err != nil {
-		c.HTML(http.StatusUnauthorized, "login.html", gin.H{"Error": "Invalid credentials"})
+		return user, false
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+		return user, false
+	}
+	return user, true
+}
+
+// Token issues a bearer token pair to an API client, for a username and
+// password or in exchange for a refresh token
+func (h *AuthHandler) Token(c *gin.Context) {
+	var req tokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		APIError(c, http.StatusBadRequest, "invalid_request", "grant_type is required")
 		return
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
-		c.HTML(http.StatusUnauthorized, "login.html", gin.H{"Error": "Invalid credentials"})
+	var pair auth.Pair
+	var err error
+	switch req.GrantType {
+	case "password":
+		user, ok := h.checkCredentials(req.Username, req.Password)
+		if !ok {
+			APIError(c, http.StatusUnauthorized, "invalid_credentials", "Invalid credentials")
+			return
+		}
+		pair, err = h.Tokens.Issue(user.ID)
+	case "refresh_token":
+		pair, err = h.Tokens.Refresh(req.RefreshToken)
+		if errors.Is(err, auth.ErrInvalidToken) {
+			APIError(c, http.StatusUnauthorized, "invalid_token", "Refresh token is invalid or expired")
+			return
+		}
+	default:
+		APIError(c, http.StatusBadRequest, "unsupported_grant_type", `grant_type must be "password" or "refresh_token"`)
+		return
+	}
+	if err != nil {
+		log.Printf("[AUTH] Issuing tokens failed: %v", err)
+		APIError(c, http.StatusInternalServerError, "internal_error", "Could not issue tokens")
 		return
 	}
 
-	session := sessions.Default(c)
-	session.Set("user_id", user.ID)
-	session.Save()
+	apiData(c, http.StatusOK, gin.H{
+		"token_type":         "Bearer",
+		"access_token":       pair.AccessToken,
+		"expires_in":         secondsUntil(pair.AccessExpiresAt),
+		"refresh_token":      pair.RefreshToken,
+		"refresh_expires_in": secondsUntil(pair.RefreshExpiresAt),
+	})
+}
 
-	c.Redirect(http.StatusFound, "/account")
+// secondsUntil is how a token lifetime is sent to clients
+func secondsUntil(t time.Time) int {
+	return int(time.Until(t).Round(time.Second).Seconds())
+}
+
+// RevokeToken logs an API client out. A bearer token is revoked together
+// with every token of its family, a session is cleared.
+func (h *AuthHandler) RevokeToken(c *gin.Context) {
+	if token, ok := c.Get("api_token"); ok {
+		if err := h.Tokens.Revoke(token.(models.APIToken).Family); err != nil {
+			log.Printf("[AUTH] Revoking tokens failed: %v", err)
+			APIError(c, http.StatusInternalServerError, "internal_error", "Could not log out")
+			return
+		}
+	} else {
+		session := sessions.Default(c)
+		session.Clear()
+		session.Save()
+	}
+	c.Status(http.StatusNoContent)
 }
 
 func (h *AuthHandler) Logout(c *gin.Context) {
@@ -73,10 +159,13 @@ func (h *AuthHandler) Account(c *gin.Context) {
 	h.DB.Preload("Transactions.Powerbank").
 		Preload("Transactions.PowerbankStationOrigin").
 		Preload("Transactions.PowerbankStationReturn").
+		Preload("Transactions.Ledger").
 		First(&user, userID)
 
 	c.HTML(http.StatusOK, "account.html", gin.H{
 		"User":       user,
 		"IsLoggedIn": true,
+		"IsAdmin":    user.Role == models.RoleAdmin,
+		"IsOperator": user.HasRole(models.RoleOperator),
 	})
 }
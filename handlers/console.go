@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"fmt"
+	"kbt-cuy/esp32"
+	"kbt-cuy/models"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// ConsoleHandler lets operators drive station locks directly, outside of a rental
+type ConsoleHandler struct {
+	DB      *gorm.DB
+	Locks   *esp32.Registry
+	Limiter *esp32.RateLimiter
+}
+
+// lockActions are the commands the console can send
+var lockActions = []string{"open", "close", "status"}
+
+// ShowConsole lists the stations with their slots and the latest commands
+func (h *ConsoleHandler) ShowConsole(c *gin.Context) {
+	h.renderConsole(c, http.StatusOK, "", "")
+}
+
+// SendCommand sends one lock command and records it in the audit log,
+// including commands refused by the rate limit
+func (h *ConsoleHandler) SendCommand(c *gin.Context) {
+	user := c.MustGet("user").(models.User)
+
+	action := c.PostForm("action")
+	reason := strings.TrimSpace(c.PostForm("reason"))
+	slotIndex, err := strconv.Atoi(c.PostForm("slot"))
+	if err != nil || !slices.Contains(lockActions, action) {
+		h.renderConsole(c, http.StatusBadRequest, "Choose a slot and a command", "")
+		return
+	}
+	if reason == "" {
+		h.renderConsole(c, http.StatusBadRequest, "A reason is required for every command", "")
+		return
+	}
+
+	var station models.PowerbankStation
+	if err := h.DB.First(&station, c.PostForm("station_id")).Error; err != nil {
+		h.renderConsole(c, http.StatusNotFound, "Station not found", "")
+		return
+	}
+	var slot models.StationSlot
+	if err := h.DB.Where("station_id = ? AND slot_index = ?", station.ID, slotIndex).First(&slot).Error; err != nil {
+		h.renderConsole(c, http.StatusBadRequest, fmt.Sprintf("%s has no slot %d", station.Name, slotIndex), "")
+		return
+	}
+
+	entry := models.LockAuditLog{
+		StationID: station.ID,
+		SlotIndex: slotIndex,
+		UserID:    user.ID,
+		Action:    action,
+		Reason:    reason,
+	}
+
+	if !h.Limiter.Allow(station.ID) {
+		entry.Result = models.AuditRateLimited
+		h.record(entry)
+		h.renderConsole(c, http.StatusTooManyRequests,
+			fmt.Sprintf("Too many commands for %s, try again in a minute", station.Name), "")
+		return
+	}
+
+	driver := h.Locks.For(station)
+	switch action {
+	case "open":
+		err = driver.Open(station, slotIndex)
+		if err == nil {
+			h.DB.Model(&slot).Update("lock_state", models.SlotUnlocked)
+		}
+	case "close":
+		err = driver.Close(station, slotIndex)
+		if err == nil {
+			h.DB.Model(&slot).Update("lock_state", models.SlotLocked)
+		}
+	case "status":
+		var status esp32.LockStatus
+		status, err = driver.Status(station, slotIndex)
+		entry.LockStatus = string(status)
+	}
+
+	if err != nil {
+		entry.Result = models.AuditFailed
+		entry.Error = err.Error()
+		h.record(entry)
+		h.renderConsole(c, http.StatusBadGateway,
+			fmt.Sprintf("%s slot %d: %s failed: %v", station.Name, slotIndex, action, err), "")
+		return
+	}
+
+	entry.Result = models.AuditSucceeded
+	h.record(entry)
+
+	message := fmt.Sprintf("%s slot %d: %s sent.", station.Name, slotIndex, action)
+	if action == "status" {
+		message = fmt.Sprintf("%s slot %d is %s.", station.Name, slotIndex, entry.LockStatus)
+	}
+	h.renderConsole(c, http.StatusOK, "", message)
+}
+
+func (h *ConsoleHandler) record(entry models.LockAuditLog) {
+	log.Printf("[CONSOLE] user=%d station=%d slot=%d %s: %s (%s)",
+		entry.UserID, entry.StationID, entry.SlotIndex, entry.Action, entry.Result, entry.Reason)
+	if err := h.DB.Create(&entry).Error; err != nil {
+		log.Printf("[CONSOLE] Failed to write audit log: %v", err)
+	}
+}
+
+func (h *ConsoleHandler) renderConsole(c *gin.Context, status int, errMsg, message string) {
+	user := c.MustGet("user").(models.User)
+
+	var stations []models.PowerbankStation
+	h.DB.Preload("Slots", func(db *gorm.DB) *gorm.DB { return db.Order("slot_index") }).
+		Preload("Slots.Powerbank").
+		Order("name").
+		Find(&stations)
+
+	var entries []models.LockAuditLog
+	h.DB.Preload("Station").Preload("User").Order("created_at DESC").Limit(50).Find(&entries)
+
+	c.HTML(status, "admin_console.html", gin.H{
+		"Stations":   stations,
+		"Entries":    entries,
+		"Actions":    lockActions,
+		"Error":      errMsg,
+		"Message":    message,
+		"IsLoggedIn": true,
+		"IsAdmin":    user.Role == models.RoleAdmin,
+		"IsOperator": true,
+	})
+}
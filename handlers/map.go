@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"kbt-cuy/models"
 	"net/http"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
@@ -16,7 +17,7 @@ type MapHandler struct {
 // ShowMap renders the station map view
 func (h *MapHandler) ShowMap(c *gin.Context) {
 	var stations []models.PowerbankStation
-	h.DB.Find(&stations)
+	h.DB.Scopes(models.WithStock).Find(&stations)
 
 	// Marshal stations to JSON to safely embed in the script tag
 	stationsJSON, err := json.Marshal(stations)
@@ -30,3 +31,28 @@ func (h *MapHandler) ShowMap(c *gin.Context) {
 		"IsLoggedIn":   true,
 	})
 }
+
+// queryLocation reads the user's position from ?lat= and ?lng=. ok is false
+// if either is missing or not a valid coordinate.
+func queryLocation(c *gin.Context) (lat, lng float64, ok bool) {
+	lat, errLat := strconv.ParseFloat(c.Query("lat"), 64)
+	lng, errLng := strconv.ParseFloat(c.Query("lng"), 64)
+	if errLat != nil || errLng != nil || lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+		return 0, 0, false
+	}
+	return lat, lng, true
+}
+
+// nearestFirst sorts the stations by distance from the location the page was
+// opened with. Without one the order is kept and located is false.
+func nearestFirst(c *gin.Context, stations []models.PowerbankStation) (nearby []models.NearbyStation, located bool) {
+	lat, lng, ok := queryLocation(c)
+	if !ok {
+		nearby = make([]models.NearbyStation, len(stations))
+		for i, station := range stations {
+			nearby[i] = models.NearbyStation{PowerbankStation: station}
+		}
+		return nearby, false
+	}
+	return models.ByDistance(stations, lat, lng), true
+}
@@ -1,8 +1,14 @@
 package handlers
 
 import (
-	"kbt-cuy/esp32"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
 	"kbt-cuy/models"
+	"kbt-cuy/pricing"
+	"kbt-cuy/rental"
+	"log"
 	"net/http"
 	"os"
 	"strconv"
@@ -11,211 +17,171 @@ import (
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
 	"github.com/midtrans/midtrans-go"
-	"github.com/midtrans/midtrans-go/coreapi"
-	"github.com/midtrans/midtrans-go/snap"
 	"gorm.io/gorm"
 )
 
 type PaymentHandler struct {
-	DB   *gorm.DB
-	Core *coreapi.Client
-	Snap *snap.Client
+	DB        *gorm.DB
+	ServerKey string // Midtrans server key, used to verify notification signatures
+	Pricing   *pricing.Engine
+	Rentals   *rental.Service // Creates orders and syncs their payment with Midtrans
+}
+
+// midtransNotification is the subset of the Midtrans HTTP notification we rely on
+type midtransNotification struct {
+	OrderID           string `json:"order_id"`
+	StatusCode        string `json:"status_code"`
+	GrossAmount       string `json:"gross_amount"`
+	SignatureKey      string `json:"signature_key"`
+	TransactionStatus string `json:"transaction_status"`
 }
 
 // ShowPaymentPage renders the payment confirmation screen
 func (h *PaymentHandler) ShowPaymentPage(c *gin.Context) {
 	stationID := c.Param("id")
 	var station models.PowerbankStation
-	if err := h.DB.First(&station, stationID).Error; err != nil {
+	if err := h.DB.Scopes(models.WithStock).First(&station, stationID).Error; err != nil {
 		c.String(http.StatusNotFound, "Station not found")
 		return
 	}
 
+	if !station.Online {
+		c.String(http.StatusServiceUnavailable, "This station is offline right now, please choose another station")
+		return
+	}
+
+	plan, err := h.Pricing.PlanFor(station.ID)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Could not load tariff")
+		return
+	}
+
 	clientKey := os.Getenv("MIDTRANS_CLIENT_KEY_FRONTEND")
 
 	c.HTML(http.StatusOK, "payment.html", gin.H{
 		"Station":    station,
 		"IsLoggedIn": true,
 		"ClientKey":  clientKey,
+		"Tariff":     pricing.Describe(plan),
+		"Upfront":    pricing.Upfront(plan, time.Now()),
 	})
 }
 
 // CreateTransaction creates a new Midtrans Snap transaction
 func (h *PaymentHandler) CreateTransaction(c *gin.Context) {
-	stationIDStr := c.PostForm("station_id")
-	stationID, _ := strconv.ParseUint(stationIDStr, 10, 32)
+	stationID, _ := strconv.ParseUint(c.PostForm("station_id"), 10, 32)
 	session := sessions.Default(c)
 	userID := session.Get("user_id").(uint)
 
-	var user models.User
-	h.DB.First(&user, userID)
-
-	orderID := "ORDER-" + strconv.FormatInt(time.Now().Unix(), 10)
-
-	snapReq := &snap.Request{
-		TransactionDetails: midtrans.TransactionDetails{
-			OrderID:  orderID,
-			GrossAmt: 10000,
-		},
-		CreditCard: &snap.CreditCardDetails{
-			Secure: true,
-		},
-		CustomerDetail: &midtrans.CustomerDetails{
-			FName: user.Username,
-			Email: user.Email,
-		},
-		Items: &[]midtrans.ItemDetails{
-			{
-				ID:    stationIDStr,
-				Name:  "Powerbank Rental",
-				Price: 10000,
-				Qty:   1,
-			},
-		},
-	}
-
-	snapResp, err := h.Snap.CreateTransaction(snapReq)
+	transaction, err := h.Rentals.CreateOrder(userID, uint(stationID))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create transaction", "details": err.Error()})
-		return
-	}
-
-	transaction := models.Transaction{
-		UserID:                   userID,
-		PowerbankStationOriginID: uint(stationID),
-		Status:                   "Pending",
-		OrderID:                  orderID,
-		PaymentToken:             snapResp.Token,
-		PaymentRedirectURL:       snapResp.RedirectURL,
-	}
-
-	if result := h.DB.Create(&transaction); result.Error != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save transaction"})
+		status, _, message := orderError(err)
+		response := gin.H{"error": message}
+		var midtransErr *midtrans.Error
+		if errors.As(err, &midtransErr) {
+			response["details"] = midtransErr.Error()
+		}
+		c.JSON(status, response)
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"token":          snapResp.Token,
+		"token":          transaction.PaymentToken,
 		"transaction_id": transaction.ID,
 	})
 }
 
+// orderError maps the reasons rental.Service.CreateOrder fails to the status, API error
+// code and message shown to the user
+func orderError(err error) (status int, code, message string) {
+	switch {
+	case errors.Is(err, rental.ErrStationOffline):
+		return http.StatusServiceUnavailable, "station_offline", "Station is offline"
+	case errors.Is(err, rental.ErrTariffUnavailable):
+		return http.StatusInternalServerError, "tariff_unavailable", "Failed to load tariff"
+	case errors.Is(err, rental.ErrPaymentGateway):
+		return http.StatusBadGateway, "payment_unavailable", "Failed to create transaction"
+	default:
+		return http.StatusInternalServerError, "internal_error", "Failed to save transaction"
+	}
+}
+
 // PaymentNotification handles the webhook from Midtrans
 func (h *PaymentHandler) PaymentNotification(c *gin.Context) {
-	var notificationPayload map[string]interface{}
-	c.ShouldBindJSON(&notificationPayload)
-
-	orderID, _ := notificationPayload["order_id"].(string)
-
-	transactionStatus, err := h.Core.CheckTransaction(orderID)
-	if err != nil {
+	var notification midtransNotification
+	if err := c.ShouldBindJSON(&notification); err != nil || notification.OrderID == "" {
+		log.Printf("[PAYMENT] Rejected notification from %s: malformed payload", c.ClientIP())
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid notification payload"})
 		return
 	}
 
-	if transactionStatus != nil {
-		if transactionStatus.TransactionStatus == "capture" || transactionStatus.TransactionStatus == "settlement" {
-			h.processSuccessfulRental(orderID)
-		}
+	if !h.validSignature(notification) {
+		log.Printf("[PAYMENT] Rejected notification for order %s from %s: invalid signature", notification.OrderID, c.ClientIP())
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid signature"})
+		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"status": "ok"})
-}
-
-// GetPaymentStatus polls Midtrans for the latest transaction status
-func (h *PaymentHandler) GetPaymentStatus(c *gin.Context) {
-	txID := c.Param("id")
 	var transaction models.Transaction
-	h.DB.First(&transaction, txID)
-
-	transactionStatus, err := h.Core.CheckTransaction(transaction.OrderID)
-	if err != nil {
-		c.JSON(http.StatusOK, gin.H{"status": "pending"})
+	if err := h.DB.Where("order_id = ?", notification.OrderID).First(&transaction).Error; err != nil {
+		log.Printf("[PAYMENT] Rejected notification for order %s from %s: unknown order", notification.OrderID, c.ClientIP())
+		c.JSON(http.StatusNotFound, gin.H{"error": "Transaction not found"})
 		return
 	}
 
-	if transactionStatus != nil {
-		// Payment is confirmed by Midtrans
-		if transactionStatus.TransactionStatus == "capture" || transactionStatus.TransactionStatus == "settlement" {
-			// Check if we need to process the rental (state is still "Pending")
-			if transaction.Status == "Pending" {
-				h.processSuccessfulRental(transaction.OrderID)
-				// After processing, let's check the new status of our internal transaction
-				var updatedTx models.Transaction
-				h.DB.First(&updatedTx, txID)
-				if updatedTx.Status == "Ongoing" {
-					c.JSON(http.StatusOK, gin.H{"status": "success", "transaction_id": updatedTx.ID})
-				} else {
-					// This can happen if processSuccessfulRental fails (e.g., no powerbanks left)
-					c.JSON(http.StatusOK, gin.H{"status": "failed"})
-				}
-				return // Important to return here
-			} else if transaction.Status == "Ongoing" {
-				// Already processed, just confirm success
-				c.JSON(http.StatusOK, gin.H{"status": "success", "transaction_id": transaction.ID})
-				return
-			}
-		} else if transactionStatus.TransactionStatus == "deny" || transactionStatus.TransactionStatus == "expire" || transactionStatus.TransactionStatus == "cancel" {
-			// Handle failed payment
-			if transaction.Status != "Failed" {
-				transaction.Status = "Failed"
-				h.DB.Save(&transaction)
-			}
-			c.JSON(http.StatusOK, gin.H{"status": "failed"})
-			return
-		}
-	}
-
-	// If none of the above, the payment is still pending
-	c.JSON(http.StatusOK, gin.H{"status": "pending"})
-}
-
-// processSuccessfulRental handles the logic for a successful rental
-func (h *PaymentHandler) processSuccessfulRental(orderID string) {
-	var tx models.Transaction
-	if err := h.DB.Where("order_id = ?", orderID).First(&tx).Error; err != nil {
+	if !rental.AmountMatches(transaction, notification.GrossAmount) {
+		log.Printf("[PAYMENT] Rejected notification for order %s from %s: gross amount %s does not match %d",
+			notification.OrderID, c.ClientIP(), notification.GrossAmount, transaction.GrossAmount)
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Gross amount mismatch"})
 		return
 	}
 
-	if tx.Status == "Ongoing" {
+	// The signature proves the payload came from Midtrans, but we still ask
+	// Midtrans directly so a replayed notification can't change the outcome.
+	err := h.Rentals.SyncPayment(&transaction)
+	if errors.Is(err, rental.ErrPaymentUnchecked) {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to verify transaction status"})
 		return
 	}
-
-	var pb models.Powerbank
-	if err := h.DB.Where("current_station_id = ? AND status = ?", tx.PowerbankStationOriginID, "Available").First(&pb).Error; err != nil {
-		tx.Status = "Failed"
-		h.DB.Save(&tx)
+	if errors.Is(err, rental.ErrAmountMismatch) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Gross amount mismatch"})
 		return
 	}
 
-	dbTx := h.DB.Begin()
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
 
-	pbId := pb.ID
-	tx.Status = "Ongoing"
-	tx.PowerbankID = &pbId
-	if err := dbTx.Save(&tx).Error; err != nil {
-		dbTx.Rollback()
-		return
+// validSignature checks signature_key = SHA512(order_id + status_code + gross_amount + server key)
+func (h *PaymentHandler) validSignature(n midtransNotification) bool {
+	if h.ServerKey == "" || n.SignatureKey == "" {
+		return false
 	}
+	sum := sha512.Sum512([]byte(n.OrderID + n.StatusCode + n.GrossAmount + h.ServerKey))
+	expected := hex.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(n.SignatureKey)) == 1
+}
 
-	pb.Status = "Rented"
-	pb.CurrentStationID = nil
-	if err := dbTx.Save(&pb).Error; err != nil {
-		dbTx.Rollback()
-		return
-	}
+// GetPaymentStatus polls Midtrans for the latest transaction status
+func (h *PaymentHandler) GetPaymentStatus(c *gin.Context) {
+	var transaction models.Transaction
+	h.DB.First(&transaction, c.Param("id"))
 
-	var station models.PowerbankStation
-	if err := dbTx.First(&station, tx.PowerbankStationOriginID).Error; err != nil {
-		dbTx.Rollback()
-		return
-	}
-	station.PowerbankLeft--
-	if err := dbTx.Save(&station).Error; err != nil {
-		dbTx.Rollback()
+	// Midtrans may not know the order yet, the page keeps polling
+	if err := h.Rentals.SyncPayment(&transaction); errors.Is(err, rental.ErrAmountMismatch) {
+		c.JSON(http.StatusOK, gin.H{"status": "failed"})
 		return
 	}
+	c.JSON(http.StatusOK, paymentStatusResponse(transaction))
+}
 
-	dbTx.Commit()
-
-	go esp32.TriggerLock(station.IPAddress, "open")
+// paymentStatusResponse maps the internal rental state to what the payment page polls for
+func paymentStatusResponse(transaction models.Transaction) gin.H {
+	switch transaction.Status {
+	case models.StatusDispensing, models.StatusOngoing:
+		return gin.H{"status": "success", "transaction_id": transaction.ID}
+	case models.StatusFailed, models.StatusRefunded, models.StatusCancelled:
+		// This can happen if rental.Service.ConfirmPayment fails (e.g., no powerbanks left)
+		return gin.H{"status": "failed"}
+	default:
+		return gin.H{"status": "pending"}
+	}
 }
@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"kbt-cuy/billing"
+	"kbt-cuy/esp32"
+	"kbt-cuy/internal/testdb"
+	"kbt-cuy/models"
+	"kbt-cuy/pricing"
+	"kbt-cuy/rental"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/midtrans/midtrans-go"
+	"github.com/midtrans/midtrans-go/coreapi"
+)
+
+// settledPayments answers every status check with a settled payment
+type settledPayments struct {
+	grossAmount string
+}
+
+func (p settledPayments) CheckTransaction(orderID string) (*coreapi.TransactionStatusResponse, *midtrans.Error) {
+	return &coreapi.TransactionStatusResponse{
+		OrderID:           orderID,
+		StatusCode:        "200",
+		GrossAmount:       p.grossAmount,
+		TransactionStatus: "settlement",
+	}, nil
+}
+
+func TestPaymentWebhookAndPollerDispenseOnce(t *testing.T) {
+	db := testdb.Open(t)
+
+	station := models.PowerbankStation{Name: "Test", Capacity: 4, LockDriver: models.LockDriverSimulator, DeviceSecret: "device-secret"}
+	if err := db.Create(&station).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, code := range []string{"PB-1", "PB-2", "PB-3"} {
+		if err := db.Create(&models.Powerbank{PowerbankCode: code, Capacity: 10000, Status: models.PowerbankAvailable, CurrentStationID: &station.ID}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := models.EnsureSlots(db); err != nil {
+		t.Fatal(err)
+	}
+	user := models.User{Username: "renter", Email: "renter@example.com", Password: "x"}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	order := models.Transaction{
+		UserID:                   user.ID,
+		PowerbankStationOriginID: station.ID,
+		Status:                   models.StatusPending,
+		OrderID:                  "ORDER-1",
+		GrossAmount:              10000,
+	}
+	if err := db.Create(&order).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	simulator := esp32.NewSimulator()
+	simulator.Latency = 0
+	simulator.HoldFor = 0
+	locks := esp32.NewRegistry(models.LockDriverSimulator)
+	locks.Register(models.LockDriverSimulator, simulator)
+
+	const serverKey = "server-key"
+	h := &PaymentHandler{
+		DB:        db,
+		ServerKey: serverKey,
+		Pricing:   &pricing.Engine{DB: db},
+		Rentals: &rental.Service{
+			DB:              db,
+			Billing:         &billing.Service{DB: db},
+			Pricing:         &pricing.Engine{DB: db},
+			Locks:           locks,
+			Payments:        settledPayments{grossAmount: "10000.00"},
+			DispenseTimeout: time.Minute,
+		},
+	}
+	r := gin.New()
+	r.POST("/payment/notification", h.PaymentNotification)
+	r.GET("/payment/status/:id", h.GetPaymentStatus)
+
+	sum := sha512.Sum512([]byte(order.OrderID + "200" + "10000.00" + serverKey))
+	notification, _ := json.Marshal(midtransNotification{
+		OrderID:           order.OrderID,
+		StatusCode:        "200",
+		GrossAmount:       "10000.00",
+		SignatureKey:      hex.EncodeToString(sum[:]),
+		TransactionStatus: "settlement",
+	})
+
+	// Midtrans retries its notification while the payment page keeps polling
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			<-start
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/payment/notification", strings.NewReader(string(notification))))
+			if w.Code != http.StatusOK {
+				t.Errorf("webhook answered %d: %s", w.Code, w.Body)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			<-start
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/payment/status/"+strconv.Itoa(int(order.ID)), nil))
+			if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "failed") {
+				t.Errorf("status poll answered %d: %s", w.Code, w.Body)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	var history []models.TransactionStatusChange
+	db.Where("transaction_id = ?", order.ID).Order("id").Find(&history)
+	var steps []string
+	for _, change := range history {
+		steps = append(steps, string(change.From)+"->"+string(change.To))
+	}
+	want := []string{"Pending->Paid", "Paid->Dispensing"}
+	if strings.Join(steps, " ") != strings.Join(want, " ") {
+		t.Errorf("status history = %v, want %v", steps, want)
+	}
+
+	var deposits int64
+	db.Model(&models.LedgerEntry{}).Where("transaction_id = ? AND kind = ?", order.ID, models.LedgerDeposit).Count(&deposits)
+	if deposits != 1 {
+		t.Errorf("%d deposit ledger entries, want 1", deposits)
+	}
+
+	var rented int64
+	db.Model(&models.Powerbank{}).Where("status = ?", models.PowerbankRented).Count(&rented)
+	if rented != 1 {
+		t.Errorf("%d powerbanks rented, want 1", rented)
+	}
+
+	opens := 0
+	for _, cmd := range simulator.Commands() {
+		if cmd.Action == "open" {
+			opens++
+		}
+	}
+	if opens != 1 {
+		t.Errorf("%d open commands sent, want 1", opens)
+	}
+}
@@ -1,11 +1,13 @@
 package handlers
 
 import (
-	"kbt-cuy/esp32"
+	"errors"
 	"kbt-cuy/models"
+	"kbt-cuy/pricing"
+	"kbt-cuy/rental"
+	"log"
 	"net/http"
 	"strconv"
-	"time"
 
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
@@ -13,97 +15,175 @@ import (
 )
 
 type RentalHandler struct {
-	DB *gorm.DB
+	DB      *gorm.DB
+	Rentals *rental.Service
 }
 
-// ShowRentalStations displays available stations
+// ShowRentalStations displays available stations, closest first if the page
+// was opened with the user's location
 func (h *RentalHandler) ShowRentalStations(c *gin.Context) {
 	var stations []models.PowerbankStation
-	h.DB.Where("powerbank_left > ?", 0).Find(&stations)
+	h.DB.Scopes(models.WithStock, models.HasAvailable).Find(&stations)
+	nearby, located := nearestFirst(c, stations)
 
 	c.HTML(http.StatusOK, "rental.html", gin.H{
-		"Stations":   stations,
+		"Stations":   nearby,
+		"Located":    located,
 		"IsLoggedIn": true,
 	})
 }
 
-// RentalSuccess page after successful payment and processing
+// RentalSuccess page after successful payment and processing. Only the
+// user who rented can see it.
 func (h *RentalHandler) RentalSuccess(c *gin.Context) {
-	txID := c.Param("id")
+	userID := sessions.Default(c).Get("user_id").(uint)
 	var transaction models.Transaction
-	if err := h.DB.Preload("PowerbankStationOrigin").First(&transaction, txID).Error; err != nil {
+	if err := h.DB.Preload("PowerbankStationOrigin").
+		Where("id = ? AND user_id = ?", c.Param("id"), userID).
+		First(&transaction).Error; err != nil {
 		c.String(http.StatusNotFound, "Transaction not found")
 		return
 	}
 
+	deadline := ""
+	if transaction.DispenseDeadline != nil {
+		deadline = transaction.DispenseDeadline.In(pricing.Location).Format("15:04")
+	}
+
 	c.HTML(http.StatusOK, "rental_success.html", gin.H{
 		"TransactionID": transaction.ID,
 		"StationName":   transaction.PowerbankStationOrigin.Name,
+		"SlotIndex":     transaction.OriginSlotIndex,
+		"Deadline":      deadline,
+		"Dispensing":    transaction.Status == models.StatusDispensing,
+		"Started":       transaction.DateRented != nil,
 		"IsLoggedIn":    true,
 	})
 }
 
-// ShowReturnStations displays stations with empty slots
+// ShowReturnStations displays stations with empty slots, closest first if
+// the page was opened with the user's location
 func (h *RentalHandler) ShowReturnStations(c *gin.Context) {
 	var stations []models.PowerbankStation
-	h.DB.Where("powerbank_left < capacity").Find(&stations)
+	h.DB.Scopes(models.WithStock, models.HasEmptySlot).Find(&stations)
+	nearby, located := nearestFirst(c, stations)
 
 	session := sessions.Default(c)
 	userID := session.Get("user_id").(uint)
 	var activeTx models.Transaction
-	hasActive := h.DB.Where("user_id = ? AND status = ?", userID, "Ongoing").First(&activeTx).RowsAffected > 0
+	hasActive := h.DB.Where("user_id = ? AND status = ?", userID, models.StatusOngoing).First(&activeTx).RowsAffected > 0
 
 	c.HTML(http.StatusOK, "return.html", gin.H{
-		"Stations":        stations,
+		"Stations":        nearby,
+		"Located":         located,
 		"HasActiveRental": hasActive,
 		"ActiveTxID":      activeTx.ID,
 		"IsLoggedIn":      true,
 	})
 }
 
-// ReturnPowerbank handles the return logic
+// ReturnPowerbank reserves a slot at the chosen station for the user's
+// rental and opens it
 func (h *RentalHandler) ReturnPowerbank(c *gin.Context) {
-	stationID, _ := strconv.Atoi(c.PostForm("station_id"))
-	txID, _ := strconv.Atoi(c.PostForm("transaction_id"))
-
-	txDB := h.DB.Begin()
+	stationID, _ := strconv.ParseUint(c.PostForm("station_id"), 10, 32)
+	txID, _ := strconv.ParseUint(c.PostForm("transaction_id"), 10, 32)
+	userID := sessions.Default(c).Get("user_id").(uint)
 
-	var transaction models.Transaction
-	if err := txDB.Preload("Powerbank").First(&transaction, txID).Error; err != nil {
-		txDB.Rollback()
-		c.String(http.StatusBadRequest, "Transaction not found")
+	transaction, err := h.Rentals.StartReturn(userID, uint(txID), uint(stationID))
+	if err != nil {
+		status, message := returnError(err)
+		if status == http.StatusInternalServerError {
+			log.Printf("[RENTAL] Return of transaction %d failed: %v", txID, err)
+		}
+		c.String(status, message)
 		return
 	}
 
-	var station models.PowerbankStation
-	txDB.First(&station, stationID)
+	// Redirect so that refreshing the page doesn't start the return again
+	c.Redirect(http.StatusFound, "/return/success/"+strconv.FormatUint(uint64(transaction.ID), 10))
+}
 
-	now := time.Now()
-	rtnStationID := uint(stationID)
-	transaction.PowerbankStationReturnID = &rtnStationID
-	transaction.DateReturned = &now
-	transaction.Status = "Returned"
+// ReturnSuccess shows the progress of a return until the cabinet detects the
+// powerbank, then the final charge and the refund as booked in the ledger.
+// Only the user who rented can see it.
+func (h *RentalHandler) ReturnSuccess(c *gin.Context) {
+	userID := sessions.Default(c).Get("user_id").(uint)
+	var transaction models.Transaction
+	if err := h.DB.Preload("Powerbank").Preload("PowerbankStationReturn").Preload("Ledger", func(db *gorm.DB) *gorm.DB {
+		return db.Order("id")
+	}).
+		Where("id = ? AND user_id = ?", c.Param("id"), userID).
+		First(&transaction).Error; err != nil {
+		c.String(http.StatusNotFound, "Transaction not found")
+		return
+	}
 
-	transaction.Powerbank.Status = "Available"
-	stID := uint(station.ID)
-	transaction.Powerbank.CurrentStationID = &stID
+	returned := transaction.Status == models.StatusReturned
+	penalties := transaction.Penalties()
+	var outstanding int64
+	if due := transaction.FinalAmount + penalties; due > transaction.GrossAmount {
+		outstanding = due - transaction.GrossAmount
+	}
+	data := gin.H{
+		"TransactionID":  transaction.ID,
+		"PowerbankCode":  transaction.Powerbank.PowerbankCode,
+		"Returning":      transaction.Status == models.StatusReturning,
+		"Returned":       returned,
+		"Settling":       returned && !transaction.Settled(),
+		"FinalAmount":    transaction.FinalAmount,
+		"Deposit":        transaction.GrossAmount,
+		"Penalties":      penalties,
+		"Refunded":       transaction.Refunded(),
+		"RefundRetrying": transaction.RefundRetrying(),
+		"Outstanding":    outstanding,
+		"IsLoggedIn":     true,
+	}
+	if transaction.PowerbankStationReturn != nil {
+		data["StationName"] = transaction.PowerbankStationReturn.Name
+	}
+	if transaction.ReturnSlotIndex != nil {
+		data["SlotIndex"] = *transaction.ReturnSlotIndex
+	}
+	if transaction.ReturnDeadline != nil {
+		data["Deadline"] = transaction.ReturnDeadline.In(pricing.Location).Format("15:04")
+	}
 
-	station.PowerbankLeft++
+	c.HTML(http.StatusOK, "return_success.html", data)
+}
 
-	txDB.Save(&transaction)
-	txDB.Save(&transaction.Powerbank)
-	txDB.Save(&station)
-	txDB.Commit()
+// rentalErrors maps the reasons rental.Service refuses a request to the
+// status, API error code and message shown to the user
+var rentalErrors = []struct {
+	err     error
+	status  int
+	code    string
+	message string
+}{
+	{rental.ErrRentalNotFound, http.StatusNotFound, "rental_not_found", "Rental not found"},
+	{rental.ErrNotReturnable, http.StatusConflict, "rental_not_returnable", "This rental cannot be returned"},
+	{rental.ErrNothingToOpen, http.StatusConflict, "nothing_to_open", "This rental has no slot to open"},
+	{rental.ErrStationNotFound, http.StatusNotFound, "station_not_found", "Station not found"},
+	{rental.ErrStationOffline, http.StatusServiceUnavailable, "station_offline", "This station is offline right now, please choose another station"},
+	{rental.ErrStationFull, http.StatusConflict, "station_full", "This station has no free slot, please choose another station"},
+	{rental.ErrSlotNotOpened, http.StatusBadGateway, "slot_not_opened", "The slot could not be opened, please try again or choose another station"},
+}
 
-	// AUTOMATIC TRIGGER
-	go esp32.TriggerLock(station.IPAddress, "open")
+// rentalError looks err up in rentalErrors. Unknown errors are internal and
+// shown with the fallback message.
+func rentalError(err error, fallback string) (status int, code, message string) {
+	for _, e := range rentalErrors {
+		if errors.Is(err, e.err) {
+			return e.status, e.code, e.message
+		}
+	}
+	return http.StatusInternalServerError, "internal_error", fallback
+}
 
-	// Render Success Page (Changed from Redirect)
-	c.HTML(http.StatusOK, "return_success.html", gin.H{
-		"TransactionID": transaction.ID,
-		"StationName":   station.Name,
-		"IsLoggedIn":    true,
-	})
+// returnError maps the reasons rental.Service.StartReturn refuses a return
+// to the status and message shown to the user
+func returnError(err error) (int, string) {
+	status, _, message := rentalError(err, "Could not start the return, please try again")
+	return status, message
 }
 
 // ReopenRentalDoor allows a user to trigger the lock again after the initial rental success.
@@ -114,20 +194,15 @@ func (h *RentalHandler) ReopenRentalDoor(c *gin.Context) {
 		return
 	}
 
-	session := sessions.Default(c)
-	userID := session.Get("user_id").(uint)
-
-	var transaction models.Transaction
-	if err := h.DB.Preload("PowerbankStationOrigin").
-		Where("id = ? AND user_id = ? AND status = ?", txID, userID, "Ongoing").
-		First(&transaction).Error; err != nil {
+	// The door may have closed before the powerbank was taken. A lock that
+	// doesn't answer is logged, the success page tells the user what to do.
+	// Once the powerbank was taken the slot isn't the renter's anymore.
+	userID := sessions.Default(c).Get("user_id").(uint)
+	if _, err := h.Rentals.Reopen(userID, uint(txID)); err != nil && !errors.Is(err, rental.ErrSlotNotOpened) {
 		c.String(http.StatusNotFound, "Active rental transaction not found")
 		return
 	}
 
-	// Trigger the lock again
-	esp32.TriggerLock(transaction.PowerbankStationOrigin.IPAddress, "open")
-
 	// Redirect back to the success page with a confirmation message
 	c.Redirect(http.StatusFound, "/rental/success/"+strconv.Itoa(txID))
 }
@@ -140,20 +215,12 @@ func (h *RentalHandler) ReopenReturnDoor(c *gin.Context) {
 		return
 	}
 
-	session := sessions.Default(c)
-	userID := session.Get("user_id").(uint)
-
-	var transaction models.Transaction
-	if err := h.DB.Preload("PowerbankStationReturn").
-		Where("id = ? AND user_id = ? AND status = ?", txID, userID, "Returned").
-		First(&transaction).Error; err != nil {
+	userID := sessions.Default(c).Get("user_id").(uint)
+	if _, err := h.Rentals.Reopen(userID, uint(txID)); err != nil && !errors.Is(err, rental.ErrSlotNotOpened) {
 		c.String(http.StatusNotFound, "Return transaction not found")
 		return
 	}
 
-	// Trigger the lock again
-	esp32.TriggerLock(transaction.PowerbankStationReturn.IPAddress, "open")
-
 	// Redirect back to the return success page
 	c.Redirect(http.StatusFound, "/return/success/"+strconv.Itoa(txID))
 }
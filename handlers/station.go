@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"encoding/json"
+	"kbt-cuy/esp32"
+	"kbt-cuy/models"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// StationHandler serves the endpoints called by the station cabinets themselves
+type StationHandler struct {
+	DB     *gorm.DB
+	Guard  *esp32.ReplayGuard
+	Hub    *esp32.Hub
+	Events esp32.EventHandler
+}
+
+// Heartbeat records a station's periodic health report
+func (h *StationHandler) Heartbeat(c *gin.Context) {
+	station, body, ok := h.authenticate(c)
+	if !ok {
+		return
+	}
+
+	var hb models.Heartbeat
+	if err := json.Unmarshal(body, &hb); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid heartbeat"})
+		return
+	}
+	hb.StationID = station.ID
+
+	if err := models.RecordHeartbeat(h.DB, hb, time.Now()); err != nil {
+		log.Printf("[STATION] Failed to record heartbeat for station %d: %v", station.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not record heartbeat"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// stationEvent is the body of a slot event sent over HTTP
+type stationEvent struct {
+	Event     string `json:"event"`
+	Slot      int    `json:"slot"`
+	Powerbank string `json:"powerbank"`
+	At        int64  `json:"at"` // Unix seconds, defaults to now
+}
+
+// Event receives a slot event from a station that reports over HTTP.
+// Stations on the websocket driver send the same events as frames instead.
+func (h *StationHandler) Event(c *gin.Context) {
+	station, body, ok := h.authenticate(c)
+	if !ok {
+		return
+	}
+
+	var ev stationEvent
+	if err := json.Unmarshal(body, &ev); err != nil || ev.Event == "" || ev.Slot <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid event"})
+		return
+	}
+
+	h.Events(esp32.NewEvent(station.ID, ev.Event, ev.Slot, ev.Powerbank, ev.At, time.Now()))
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// Connect upgrades a signed request to the WebSocket that stations using the
+// websocket lock driver keep open to receive commands
+func (h *StationHandler) Connect(c *gin.Context) {
+	station, _, ok := h.authenticate(c)
+	if !ok {
+		return
+	}
+	if station.LockDriver != models.LockDriverWebSocket {
+		c.JSON(http.StatusConflict, gin.H{"error": "station is not configured for the websocket driver"})
+		return
+	}
+
+	w := hijackWriter{ResponseWriter: c.Writer.(interface{ Unwrap() http.ResponseWriter }).Unwrap(), Hijacker: c.Writer}
+	err := h.Hub.ServeWebSocket(w, c.Request, station.ID)
+	log.Printf("[STATION] Connection of station %d closed: %v", station.ID, err)
+}
+
+// hijackWriter writes the upgrade response straight to net/http, since gin
+// buffers the status line, but hijacks through gin so it knows the response
+// is taken and doesn't write its own afterwards
+type hijackWriter struct {
+	http.ResponseWriter
+	http.Hijacker
+}
+
+// authenticate checks the signature headers of a station request against
+// the station's DeviceSecret and returns the station and the raw body
+func (h *StationHandler) authenticate(c *gin.Context) (models.PowerbankStation, []byte, bool) {
+	var station models.PowerbankStation
+
+	body, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "could not read body"})
+		return station, nil, false
+	}
+
+	stationID, err := strconv.ParseUint(c.GetHeader(esp32.HeaderStationID), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "missing station id"})
+		return station, nil, false
+	}
+	if err := h.DB.First(&station, stationID).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unknown station"})
+		return station, nil, false
+	}
+
+	timestamp, _ := strconv.ParseInt(c.GetHeader(esp32.HeaderTimestamp), 10, 64)
+	sig := esp32.Signature{
+		Timestamp: timestamp,
+		Nonce:     c.GetHeader(esp32.HeaderNonce),
+		Value:     c.GetHeader(esp32.HeaderSignature),
+	}
+	message := esp32.RequestMessage(c.Request.Method, c.Request.URL.Path, body)
+	if err := h.Guard.Verify(station.DeviceSecret, message, sig, time.Now()); err != nil {
+		log.Printf("[STATION] Rejected %s from station %d: %v", c.Request.URL.Path, station.ID, err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return station, nil, false
+	}
+	return station, body, true
+}
@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"bytes"
+	"kbt-cuy/esp32"
+	"kbt-cuy/internal/testdb"
+	"kbt-cuy/models"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestStationAuthenticate(t *testing.T) {
+	db := testdb.Open(t)
+	station := models.PowerbankStation{Name: "Test", Capacity: 4, DeviceSecret: "device-secret"}
+	if err := db.Create(&station).Error; err != nil {
+		t.Fatal(err)
+	}
+	h := &StationHandler{DB: db, Guard: esp32.NewReplayGuard(30 * time.Second)}
+
+	const path = "/station/heartbeat"
+	body := []byte(`{"slots":[]}`)
+	tests := []struct {
+		name      string
+		stationID string
+		signed    []byte // Body the signature was made for
+		sent      []byte
+		wantOK    bool
+		wantCode  int
+		wantError string
+	}{
+		{"valid", strconv.Itoa(int(station.ID)), body, body, true, http.StatusOK, ""},
+		{"wrong body hash", strconv.Itoa(int(station.ID)), body, []byte(`{"slots":[1]}`), false, http.StatusUnauthorized, esp32.ErrBadSignature.Error()},
+		{"unknown station", "999", body, body, false, http.StatusUnauthorized, "unknown station"},
+		{"missing station id", "", body, body, false, http.StatusUnauthorized, "missing station id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sig := esp32.Sign(station.DeviceSecret, esp32.RequestMessage(http.MethodPost, path, tt.signed), time.Now())
+			req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(tt.sent))
+			req.Header.Set(esp32.HeaderStationID, tt.stationID)
+			req.Header.Set(esp32.HeaderTimestamp, strconv.FormatInt(sig.Timestamp, 10))
+			req.Header.Set(esp32.HeaderNonce, sig.Nonce)
+			req.Header.Set(esp32.HeaderSignature, sig.Value)
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = req
+
+			got, gotBody, ok := h.authenticate(c)
+			if ok != tt.wantOK || w.Code != tt.wantCode {
+				t.Fatalf("authenticate ok = %v with status %d, want %v with %d (%s)", ok, w.Code, tt.wantOK, tt.wantCode, w.Body)
+			}
+			if !ok && !strings.Contains(w.Body.String(), tt.wantError) {
+				t.Errorf("error body = %s, want %q", w.Body, tt.wantError)
+			}
+			if ok && (got.ID != station.ID || !bytes.Equal(gotBody, tt.sent)) {
+				t.Errorf("authenticate = station %d, body %q", got.ID, gotBody)
+			}
+		})
+	}
+}
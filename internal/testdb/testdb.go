@@ -0,0 +1,34 @@
+// Package testdb gives tests a migrated database without touching the
+// application's own in-memory or file database
+package testdb
+
+import (
+	"kbt-cuy/migrations"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Open returns a fresh, fully migrated in-memory SQLite database named after
+// the test. It is dropped when the test ends, as the memdb VFS keeps a
+// database only while a connection to it is open.
+func Open(t testing.TB) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open("file:/"+t.Name()+"?vfs=memdb&_busy_timeout=5000"),
+		&gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+
+	if _, err := migrations.Up(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
@@ -1,19 +1,29 @@
 package main
 
 import (
-	"database/sql"
+	"context"
+	"errors"
+	"html/template"
+	"kbt-cuy/auth"
+	"kbt-cuy/billing"
 	"kbt-cuy/config"
+	database "kbt-cuy/db"
+	"kbt-cuy/esp32"
 	"kbt-cuy/handlers"
+	"kbt-cuy/migrations"
 	"kbt-cuy/models"
+	"kbt-cuy/overdue"
+	"kbt-cuy/pricing"
+	"kbt-cuy/rental"
 	"log"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-contrib/sessions/cookie"
 	"github.com/gin-gonic/gin"
-	_ "github.com/tursodatabase/libsql-client-go/libsql"
-	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
@@ -21,33 +31,113 @@ func main() {
 	// 1. Load Configuration
 	config.LoadConfig()
 
-	// 2. Database Connection (Turso)
-	sqlDB, err := sql.Open("libsql", config.TursoURL+"?authToken="+config.TursoToken)
+	models.StationOfflineAfter = config.StationOfflineAfter
+
+	// 2. Database Connection (Turso, local SQLite file or in-memory)
+	db, err := database.Open(config.DatabaseURL)
 	if err != nil {
 		log.Fatal("Failed to connect to database:", err)
 	}
-	db, err := gorm.Open(sqlite.Dialector{Conn: sqlDB}, &gorm.Config{})
-	if err != nil {
-		log.Fatal("Failed to initialize GORM:", err)
+	log.Println("Using database", database.Describe(config.DatabaseURL))
+
+	// An in-memory database starts empty, so it can only be migrated here
+	if database.IsMemory(config.DatabaseURL) {
+		if _, err := migrations.Up(db); err != nil {
+			log.Fatal("Failed to migrate in-memory database:", err)
+		}
 	}
 
-	// 3. Migrate Schema
-	db.AutoMigrate(&models.User{}, &models.PowerbankStation{}, &models.Powerbank{}, &models.Transaction{})
+	// 3. Check Schema (migrations are applied with `go run ./cmd/migrate up`)
+	pending, err := migrations.Pending(db)
+	if err != nil {
+		log.Fatal("Failed to read schema version:", err)
+	}
+	if len(pending) > 0 {
+		log.Fatalf("Database schema is behind: %d pending migration(s), expected version %d. Run `go run ./cmd/migrate up` first.",
+			len(pending), migrations.Latest())
+	}
 
 	// 4. Seed Demo Data
 	seedData(db)
+	if err := models.EnsureSlots(db); err != nil {
+		log.Fatal("Failed to create station slots:", err)
+	}
+	promoteAdmins(db)
 
 	// 5. Router Setup
 	r := gin.Default()
+	r.SetFuncMap(template.FuncMap{"rupiah": pricing.FormatIDR})
 	r.LoadHTMLGlob("templates/*")
 
 	store := cookie.NewStore([]byte("secret"))
 	r.Use(sessions.Sessions("mysession", store))
 
-	authHandler := &handlers.AuthHandler{DB: db}
-	rentalHandler := &handlers.RentalHandler{DB: db}
-	paymentHandler := &handlers.PaymentHandler{DB: db, Core: config.MidtransCore, Snap: config.MidtransSnap}
+	pricingEngine := &pricing.Engine{DB: db}
+	billingService := &billing.Service{DB: db, Midtrans: config.MidtransCore}
+	locks := esp32.NewRegistry(models.LockDriverHTTP)
+	rentalService := &rental.Service{
+		DB:              db,
+		Billing:         billingService,
+		Pricing:         pricingEngine,
+		Locks:           locks,
+		Checkout:        config.MidtransSnap,
+		Payments:        config.MidtransCore,
+		DispenseTimeout: config.DispenseTimeout,
+		ReturnTimeout:   config.ReturnTimeout,
+	}
+
+	// Slot events reach the rental service whichever way the cabinet is connected
+	simulator := esp32.NewSimulator()
+	simulator.Events = rentalService.HandleEvent
+	simulator.Expect = rentalService.Expected
+	hub := esp32.NewHub()
+	hub.Events = rentalService.HandleEvent
+
+	locks.Register(models.LockDriverHTTP, esp32.NewHTTPDriver())
+	locks.Register(models.LockDriverSimulator, simulator)
+	locks.Register(models.LockDriverWebSocket, hub)
+
+	tokens := &auth.Service{DB: db, AccessTTL: config.AccessTokenTTL, RefreshTTL: config.RefreshTokenTTL}
+	authHandler := &handlers.AuthHandler{DB: db, Tokens: tokens}
+	rentalHandler := &handlers.RentalHandler{DB: db, Rentals: rentalService}
+	paymentHandler := &handlers.PaymentHandler{
+		DB:        db,
+		ServerKey: config.MidtransServerKey,
+		Pricing:   pricingEngine,
+		Rentals:   rentalService,
+	}
 	mapHandler := &handlers.MapHandler{DB: db}
+	apiHandler := &handlers.APIHandler{
+		DB:      db,
+		Pricing: pricingEngine,
+		Rentals: rentalService,
+	}
+	stationHandler := &handlers.StationHandler{
+		DB:     db,
+		Guard:  esp32.NewReplayGuard(30 * time.Second),
+		Hub:    hub,
+		Events: rentalService.HandleEvent,
+	}
+	adminHandler := &handlers.AdminHandler{DB: db, Pricing: pricingEngine}
+	consoleHandler := &handlers.ConsoleHandler{
+		DB:      db,
+		Locks:   locks,
+		Limiter: esp32.NewRateLimiter(config.LockCommandsPerMinute, time.Minute),
+	}
+
+	// Background worker for rentals that are not returned in time
+	overdueWorker := &overdue.Worker{
+		DB:        db,
+		Pricing:   pricingEngine,
+		Allowance: config.RentalAllowance,
+		LostAfter: config.LostAfter,
+		Interval:  config.OverdueScanInterval,
+	}
+	go overdueWorker.Run(context.Background())
+
+	// Paid rentals whose powerbank is never taken are rolled back and refunded,
+	// returns whose powerbank is never detected are cancelled
+	go rentalService.Watch(context.Background(), 10*time.Second)
 
 	// 6. Routes
 	r.GET("/", func(c *gin.Context) {
@@ -83,11 +173,70 @@ func main() {
 		// Return Flow
 		authorized.GET("/return", rentalHandler.ShowReturnStations)
 		authorized.POST("/return", rentalHandler.ReturnPowerbank)
+		authorized.GET("/return/success/:id", rentalHandler.ReturnSuccess)
 		authorized.POST("/return/re-open", rentalHandler.ReopenReturnDoor)
 	}
 
+	// JSON API for the mobile app
+	r.POST("/api/v1/auth/token", authHandler.Token)
+
+	api := r.Group("/api/v1")
+	api.Use(APIAuthRequired(tokens))
+	{
+		api.POST("/auth/logout", authHandler.RevokeToken)
+
+		api.GET("/stations", apiHandler.ListStations)
+		api.GET("/stations/nearby", apiHandler.NearbyStations)
+		api.GET("/stations/:id", apiHandler.GetStation)
+
+		api.GET("/rentals", apiHandler.ListRentals)
+		api.POST("/rentals", apiHandler.CreateRental)
+		api.GET("/rentals/:id", apiHandler.GetRental)
+		api.POST("/rentals/:id/return", apiHandler.ReturnRental)
+		api.POST("/rentals/:id/reopen", apiHandler.ReopenRental)
+
+		api.GET("/account", apiHandler.Account)
+		api.GET("/account/history", apiHandler.History)
+	}
+
+	// Admin Routes
+	admin := r.Group("/admin")
+	admin.Use(AuthRequired(), AdminRequired(db))
+	{
+		admin.GET("", adminHandler.Dashboard)
+		admin.GET("/stations", adminHandler.ListStations)
+		admin.GET("/stations/new", adminHandler.NewStation)
+		admin.POST("/stations", adminHandler.CreateStation)
+		admin.GET("/stations/:id/edit", adminHandler.EditStation)
+		admin.POST("/stations/:id", adminHandler.UpdateStation)
+		admin.GET("/tariffs", adminHandler.ListTariffs)
+		admin.GET("/tariffs/new", adminHandler.NewTariff)
+		admin.POST("/tariffs", adminHandler.CreateTariff)
+		admin.GET("/tariffs/:id/edit", adminHandler.EditTariff)
+		admin.POST("/tariffs/:id", adminHandler.UpdateTariff)
+		admin.GET("/powerbanks", adminHandler.ListPowerbanks)
+		admin.POST("/powerbanks", adminHandler.RegisterPowerbank)
+		admin.GET("/transactions", adminHandler.ListTransactions)
+		admin.GET("/users", adminHandler.ListUsers)
+		admin.POST("/users/:id/role", adminHandler.UpdateUserRole)
+		admin.GET("/overdue", adminHandler.OverdueRentals)
+	}
+
+	// Lock console, also open to operators
+	console := r.Group("/admin/console")
+	console.Use(AuthRequired(), RoleRequired(db, models.RoleOperator))
+	{
+		console.GET("", consoleHandler.ShowConsole)
+		console.POST("", consoleHandler.SendCommand)
+	}
+
 	r.POST("/payment/notification", paymentHandler.PaymentNotification)
 
+	// Called by the station cabinets, signed with their device secret
+	r.POST("/station/heartbeat", stationHandler.Heartbeat)
+	r.POST("/station/events", stationHandler.Event)
+	r.GET("/station/ws", stationHandler.Connect)
+
 	// For Vercel deployment, use the PORT environment variable
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -109,22 +258,109 @@ func AuthRequired() gin.HandlerFunc {
 	}
 }
 
+// APIAuthRequired is AuthRequired for the JSON API. It accepts a bearer
+// access token or a login session and answers with a 401 error instead of
+// redirecting. The user ID is stored in the context under "user_id", a
+// bearer token under "api_token".
+func APIAuthRequired(tokens *auth.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if header := c.GetHeader("Authorization"); header != "" {
+			// A bad token is refused even if a session cookie came along
+			raw, ok := strings.CutPrefix(header, "Bearer ")
+			token, err := tokens.Authenticate(raw)
+			if !ok || err != nil {
+				if ok && !errors.Is(err, auth.ErrInvalidToken) {
+					log.Printf("[AUTH] Checking bearer token failed: %v", err)
+				}
+				handlers.APIError(c, http.StatusUnauthorized, "invalid_token", "Access token is invalid or expired")
+				return
+			}
+			c.Set("user_id", token.UserID)
+			c.Set("api_token", token)
+			c.Next()
+			return
+		}
+
+		userID, ok := sessions.Default(c).Get("user_id").(uint)
+		if !ok {
+			handlers.APIError(c, http.StatusUnauthorized, "unauthorized", "Login required")
+			return
+		}
+		c.Set("user_id", userID)
+		c.Next()
+	}
+}
+
+// RoleRequired only lets through logged in users with one of the given roles.
+// The loaded user is stored in the context under "user".
+func RoleRequired(db *gorm.DB, roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session := sessions.Default(c)
+		var user models.User
+		if err := db.First(&user, session.Get("user_id")).Error; err != nil || !user.HasRole(roles...) {
+			c.String(http.StatusForbidden, "Forbidden")
+			c.Abort()
+			return
+		}
+		c.Set("user", user)
+		c.Next()
+	}
+}
+
+// AdminRequired only lets through admins
+func AdminRequired(db *gorm.DB) gin.HandlerFunc {
+	return RoleRequired(db, models.RoleAdmin)
+}
+
+// promoteAdmins gives the existing users listed in ADMIN_USERNAMES the admin
+// role while there is no admin yet, so a fresh deployment has someone who
+// can open the admin pages. After that roles are only changed at
+// /admin/users, and a demotion made there survives a restart.
+func promoteAdmins(db *gorm.DB) {
+	if len(config.AdminUsernames) == 0 {
+		return
+	}
+	var admins int64
+	if err := db.Model(&models.User{}).Where("role = ?", models.RoleAdmin).Count(&admins).Error; err != nil {
+		log.Println("Failed to count admins:", err)
+		return
+	}
+	if admins > 0 {
+		return
+	}
+	result := db.Model(&models.User{}).
+		Where("username IN ? AND role <> ?", config.AdminUsernames, models.RoleAdmin).
+		Update("role", models.RoleAdmin)
+	if result.Error != nil {
+		log.Println("Failed to promote admins:", result.Error)
+	} else if result.RowsAffected > 0 {
+		log.Printf("Promoted %d user(s) from ADMIN_USERNAMES to admin", result.RowsAffected)
+	}
+}
+
 func seedData(db *gorm.DB) {
+	var plans int64
+	db.Model(&models.TariffPlan{}).Count(&plans)
+	if plans == 0 {
+		plan := pricing.StandardPlan
+		db.Create(&plan)
+	}
+
 	var count int64
 	db.Model(&models.PowerbankStation{}).Count(&count)
 	if count == 0 {
 		// 1. Create Main Central Station
 		station1 := models.PowerbankStation{
-			Name: "Kantin Pusat ITS", Latitude: -7.2839100, Longitude: 112.7940321, Capacity: 10, PowerbankLeft: 5, IPAddress: "192.168.1.50",
+			Name: "Kantin Pusat ITS", Latitude: -7.2839100, Longitude: 112.7940321, Capacity: 10, IPAddress: "192.168.1.50", LockDriver: models.LockDriverSimulator, DeviceSecret: models.NewDeviceSecret(),
 		}
 		db.Create(&station1)
-		db.Create(&models.Powerbank{PowerbankCode: "PB-001", Capacity: 10000, Status: "Available", CurrentStationID: &station1.ID})
-		db.Create(&models.Powerbank{PowerbankCode: "PB-002", Capacity: 10000, Status: "Available", CurrentStationID: &station1.ID})
+		db.Create(&models.Powerbank{PowerbankCode: "PB-001", Capacity: 10000, Status: models.PowerbankAvailable, CurrentStationID: &station1.ID})
+		db.Create(&models.Powerbank{PowerbankCode: "PB-002", Capacity: 10000, Status: models.PowerbankAvailable, CurrentStationID: &station1.ID})
 
 		station2 := models.PowerbankStation{
-			Name: "Tower 2 ITS", Latitude: -7.2851831, Longitude: 112.7952606, Capacity: 8, PowerbankLeft: 3, IPAddress: "192.168.1.50",
+			Name: "Tower 2 ITS", Latitude: -7.2851831, Longitude: 112.7952606, Capacity: 8, IPAddress: "192.168.1.50", LockDriver: models.LockDriverSimulator, DeviceSecret: models.NewDeviceSecret(),
 		}
 		db.Create(&station2)
-		db.Create(&models.Powerbank{PowerbankCode: "PB-003", Capacity: 10000, Status: "Available", CurrentStationID: &station2.ID})
+		db.Create(&models.Powerbank{PowerbankCode: "PB-003", Capacity: 10000, Status: models.PowerbankAvailable, CurrentStationID: &station2.ID})
 	}
 }
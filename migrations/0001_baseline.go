@@ -0,0 +1,31 @@
+package migrations
+
+// baseline is the schema the original AutoMigrate created. It uses IF NOT
+// EXISTS so it can be recorded as applied on databases that already have it.
+var baseline = Migration{
+	Version: 1,
+	Name:    "baseline",
+	Up: exec(
+		"CREATE TABLE IF NOT EXISTS `users` (`id` integer PRIMARY KEY AUTOINCREMENT,`created_at` datetime,`updated_at` datetime,`deleted_at` datetime,`username` text NOT NULL,`email` text NOT NULL,`password` text NOT NULL)",
+		"CREATE UNIQUE INDEX IF NOT EXISTS `idx_users_email` ON `users`(`email`)",
+		"CREATE UNIQUE INDEX IF NOT EXISTS `idx_users_username` ON `users`(`username`)",
+		"CREATE INDEX IF NOT EXISTS `idx_users_deleted_at` ON `users`(`deleted_at`)",
+
+		"CREATE TABLE IF NOT EXISTS `powerbank_stations` (`id` integer PRIMARY KEY AUTOINCREMENT,`created_at` datetime,`updated_at` datetime,`deleted_at` datetime,`name` text,`latitude` real,`longitude` real,`capacity` integer,`powerbank_left` integer,`ip_address` text)",
+		"CREATE INDEX IF NOT EXISTS `idx_powerbank_stations_deleted_at` ON `powerbank_stations`(`deleted_at`)",
+
+		"CREATE TABLE IF NOT EXISTS `powerbanks` (`id` integer PRIMARY KEY AUTOINCREMENT,`created_at` datetime,`updated_at` datetime,`deleted_at` datetime,`powerbank_code` text,`capacity` integer,`status` text,`current_station_id` integer,CONSTRAINT `fk_powerbank_stations_powerbanks` FOREIGN KEY (`current_station_id`) REFERENCES `powerbank_stations`(`id`))",
+		"CREATE UNIQUE INDEX IF NOT EXISTS `idx_powerbanks_powerbank_code` ON `powerbanks`(`powerbank_code`)",
+		"CREATE INDEX IF NOT EXISTS `idx_powerbanks_deleted_at` ON `powerbanks`(`deleted_at`)",
+
+		"CREATE TABLE IF NOT EXISTS `transactions` (`id` integer PRIMARY KEY AUTOINCREMENT,`created_at` datetime,`updated_at` datetime,`deleted_at` datetime,`user_id` integer,`powerbank_id` integer,`powerbank_station_origin_id` integer,`powerbank_station_return_id` integer,`status` text,`date_returned` datetime,`order_id` text,`payment_token` text,`payment_redirect_url` text,CONSTRAINT `fk_transactions_powerbank_station_origin` FOREIGN KEY (`powerbank_station_origin_id`) REFERENCES `powerbank_stations`(`id`),CONSTRAINT `fk_transactions_powerbank_station_return` FOREIGN KEY (`powerbank_station_return_id`) REFERENCES `powerbank_stations`(`id`),CONSTRAINT `fk_users_transactions` FOREIGN KEY (`user_id`) REFERENCES `users`(`id`),CONSTRAINT `fk_transactions_powerbank` FOREIGN KEY (`powerbank_id`) REFERENCES `powerbanks`(`id`))",
+		"CREATE UNIQUE INDEX IF NOT EXISTS `idx_transactions_order_id` ON `transactions`(`order_id`)",
+		"CREATE INDEX IF NOT EXISTS `idx_transactions_deleted_at` ON `transactions`(`deleted_at`)",
+	),
+	Down: exec(
+		"DROP TABLE IF EXISTS `transactions`",
+		"DROP TABLE IF EXISTS `powerbanks`",
+		"DROP TABLE IF EXISTS `powerbank_stations`",
+		"DROP TABLE IF EXISTS `users`",
+	),
+}
@@ -0,0 +1,26 @@
+package migrations
+
+// rentalLifecycle adds per-station lock drivers, the stored Midtrans amount
+// and the transaction status history
+var rentalLifecycle = Migration{
+	Version: 2,
+	Name:    "rental_lifecycle",
+	Up: steps(
+		addColumn("powerbank_stations", "lock_driver", "text DEFAULT 'http'"),
+		// The demo stations used to be simulated based on this IP address
+		exec("UPDATE `powerbank_stations` SET `lock_driver` = 'simulator' WHERE `ip_address` = '192.168.1.50' AND (`lock_driver` IS NULL OR `lock_driver` = 'http')"),
+
+		addColumn("transactions", "gross_amount", "integer"),
+
+		exec(
+			"CREATE TABLE IF NOT EXISTS `transaction_status_changes` (`id` integer PRIMARY KEY AUTOINCREMENT,`created_at` datetime,`updated_at` datetime,`deleted_at` datetime,`transaction_id` integer,`from` text,`to` text,`reason` text,CONSTRAINT `fk_transactions_status_history` FOREIGN KEY (`transaction_id`) REFERENCES `transactions`(`id`))",
+			"CREATE INDEX IF NOT EXISTS `idx_transaction_status_changes_transaction_id` ON `transaction_status_changes`(`transaction_id`)",
+			"CREATE INDEX IF NOT EXISTS `idx_transaction_status_changes_deleted_at` ON `transaction_status_changes`(`deleted_at`)",
+		),
+	),
+	Down: steps(
+		exec("DROP TABLE IF EXISTS `transaction_status_changes`"),
+		dropColumn("transactions", "gross_amount"),
+		dropColumn("powerbank_stations", "lock_driver"),
+	),
+}
@@ -0,0 +1,23 @@
+package migrations
+
+// stationSlots models the physical slots of each cabinet and remembers
+// which slot a rental was dispensed from and returned to
+var stationSlots = Migration{
+	Version: 3,
+	Name:    "station_slots",
+	Up: steps(
+		exec(
+			"CREATE TABLE IF NOT EXISTS `station_slots` (`id` integer PRIMARY KEY AUTOINCREMENT,`created_at` datetime,`updated_at` datetime,`deleted_at` datetime,`station_id` integer NOT NULL,`slot_index` integer NOT NULL,`powerbank_id` integer,`lock_state` text DEFAULT 'locked',`faulty` numeric,CONSTRAINT `fk_station_slots_powerbank` FOREIGN KEY (`powerbank_id`) REFERENCES `powerbanks`(`id`),CONSTRAINT `fk_powerbank_stations_slots` FOREIGN KEY (`station_id`) REFERENCES `powerbank_stations`(`id`))",
+			"CREATE UNIQUE INDEX IF NOT EXISTS `idx_station_slots_powerbank_id` ON `station_slots`(`powerbank_id`)",
+			"CREATE UNIQUE INDEX IF NOT EXISTS `idx_station_slot` ON `station_slots`(`station_id`,`slot_index`)",
+			"CREATE INDEX IF NOT EXISTS `idx_station_slots_deleted_at` ON `station_slots`(`deleted_at`)",
+		),
+		addColumn("transactions", "origin_slot_index", "integer"),
+		addColumn("transactions", "return_slot_index", "integer"),
+	),
+	Down: steps(
+		dropColumn("transactions", "return_slot_index"),
+		dropColumn("transactions", "origin_slot_index"),
+		exec("DROP TABLE IF EXISTS `station_slots`"),
+	),
+}
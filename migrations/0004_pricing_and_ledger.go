@@ -0,0 +1,30 @@
+package migrations
+
+// pricingAndLedger adds tariff plans, usage-based charges and the money ledger
+var pricingAndLedger = Migration{
+	Version: 4,
+	Name:    "pricing_and_ledger",
+	Up: steps(
+		exec(
+			"CREATE TABLE IF NOT EXISTS `tariff_plans` (`id` integer PRIMARY KEY AUTOINCREMENT,`created_at` datetime,`updated_at` datetime,`deleted_at` datetime,`name` text,`station_id` integer,`is_default` numeric,`unlock_fee` integer,`hourly_rate` integer,`daily_cap` integer,`peak_multiplier` real,`peak_start_hour` integer,`peak_end_hour` integer,`late_fee_per_hour` integer,`forfeit_fee` integer)",
+			"CREATE INDEX IF NOT EXISTS `idx_tariff_plans_station_id` ON `tariff_plans`(`station_id`)",
+			"CREATE INDEX IF NOT EXISTS `idx_tariff_plans_deleted_at` ON `tariff_plans`(`deleted_at`)",
+
+			"CREATE TABLE IF NOT EXISTS `ledger_entries` (`id` integer PRIMARY KEY AUTOINCREMENT,`created_at` datetime,`updated_at` datetime,`deleted_at` datetime,`transaction_id` integer,`kind` text,`amount` integer,`status` text,`reference` text,`note` text,CONSTRAINT `fk_transactions_ledger` FOREIGN KEY (`transaction_id`) REFERENCES `transactions`(`id`))",
+			"CREATE INDEX IF NOT EXISTS `idx_ledger_entries_transaction_id` ON `ledger_entries`(`transaction_id`)",
+			"CREATE INDEX IF NOT EXISTS `idx_ledger_entries_deleted_at` ON `ledger_entries`(`deleted_at`)",
+		),
+		addColumn("transactions", "date_rented", "datetime"),
+		addColumn("transactions", "tariff_plan_id", "integer"),
+		addColumn("transactions", "final_amount", "integer"),
+	),
+	Down: steps(
+		dropColumn("transactions", "final_amount"),
+		dropColumn("transactions", "tariff_plan_id"),
+		dropColumn("transactions", "date_rented"),
+		exec(
+			"DROP TABLE IF EXISTS `ledger_entries`",
+			"DROP TABLE IF EXISTS `tariff_plans`",
+		),
+	),
+}
@@ -0,0 +1,13 @@
+package migrations
+
+// userRoles gives every user a role, existing users become plain users
+var userRoles = Migration{
+	Version: 5,
+	Name:    "user_roles",
+	Up: steps(
+		addColumn("users", "role", "text NOT NULL DEFAULT 'user'"),
+	),
+	Down: steps(
+		dropColumn("users", "role"),
+	),
+}
@@ -0,0 +1,13 @@
+package migrations
+
+// lockAuditLogs records the lock commands staff send from the console
+var lockAuditLogs = Migration{
+	Version: 6,
+	Name:    "lock_audit_logs",
+	Up: exec(
+		"CREATE TABLE IF NOT EXISTS `lock_audit_logs` (`id` integer PRIMARY KEY AUTOINCREMENT,`created_at` datetime,`updated_at` datetime,`deleted_at` datetime,`station_id` integer,`slot_index` integer,`user_id` integer,`action` text,`reason` text,`result` text,`lock_status` text,`error` text,CONSTRAINT `fk_lock_audit_logs_station` FOREIGN KEY (`station_id`) REFERENCES `powerbank_stations`(`id`),CONSTRAINT `fk_lock_audit_logs_user` FOREIGN KEY (`user_id`) REFERENCES `users`(`id`))",
+		"CREATE INDEX IF NOT EXISTS `idx_lock_audit_logs_station_id` ON `lock_audit_logs`(`station_id`)",
+		"CREATE INDEX IF NOT EXISTS `idx_lock_audit_logs_deleted_at` ON `lock_audit_logs`(`deleted_at`)",
+	),
+	Down: exec("DROP TABLE IF EXISTS `lock_audit_logs`"),
+}
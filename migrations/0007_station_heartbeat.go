@@ -0,0 +1,22 @@
+package migrations
+
+// stationHeartbeat stores the last health report of each station and the
+// secret the cabinet authenticates with
+var stationHeartbeat = Migration{
+	Version: 7,
+	Name:    "station_heartbeat",
+	Up: steps(
+		addColumn("powerbank_stations", "device_secret", "text"),
+		addColumn("powerbank_stations", "last_seen_at", "datetime"),
+		addColumn("powerbank_stations", "firmware_version", "text"),
+		addColumn("powerbank_stations", "uptime_seconds", "integer"),
+		addColumn("powerbank_stations", "rssi", "integer"),
+	),
+	Down: steps(
+		dropColumn("powerbank_stations", "rssi"),
+		dropColumn("powerbank_stations", "uptime_seconds"),
+		dropColumn("powerbank_stations", "firmware_version"),
+		dropColumn("powerbank_stations", "last_seen_at"),
+		dropColumn("powerbank_stations", "device_secret"),
+	),
+}
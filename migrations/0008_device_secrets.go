@@ -0,0 +1,13 @@
+package migrations
+
+// deviceSecrets gives every station without one a random device secret,
+// now that lock commands and heartbeats must be signed with it
+var deviceSecrets = Migration{
+	Version: 8,
+	Name:    "device_secrets",
+	Up: exec(
+		"UPDATE `powerbank_stations` SET `device_secret` = lower(hex(randomblob(16))) WHERE `device_secret` IS NULL OR `device_secret` = ''",
+	),
+	// Secrets may already be flashed into cabinets, so they are kept
+	Down: exec(),
+}
@@ -0,0 +1,10 @@
+package migrations
+
+// dispenseDeadline lets a rental wait in Dispensing until the cabinet
+// reports the powerbank was taken, and be rolled back when it never does
+var dispenseDeadline = Migration{
+	Version: 9,
+	Name:    "dispense_deadline",
+	Up:      addColumn("transactions", "dispense_deadline", "datetime"),
+	Down:    dropColumn("transactions", "dispense_deadline"),
+}
@@ -0,0 +1,16 @@
+package migrations
+
+// returnDetection lets a return wait until the cabinet detects the unit and
+// keeps a note on rentals whose cabinet reports need a look from an admin
+var returnDetection = Migration{
+	Version: 10,
+	Name:    "return_detection",
+	Up: steps(
+		addColumn("transactions", "return_deadline", "datetime"),
+		addColumn("transactions", "review_note", "text"),
+	),
+	Down: steps(
+		dropColumn("transactions", "review_note"),
+		dropColumn("transactions", "return_deadline"),
+	),
+}
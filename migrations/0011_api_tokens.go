@@ -0,0 +1,15 @@
+package migrations
+
+// apiTokens stores the hashed access and refresh tokens of API clients
+var apiTokens = Migration{
+	Version: 11,
+	Name:    "api_tokens",
+	Up: exec(
+		"CREATE TABLE IF NOT EXISTS `api_tokens` (`id` integer PRIMARY KEY AUTOINCREMENT,`created_at` datetime,`updated_at` datetime,`deleted_at` datetime,`user_id` integer,`kind` text NOT NULL,`hash` text NOT NULL,`family` text NOT NULL,`expires_at` datetime,`revoked_at` datetime,CONSTRAINT `fk_api_tokens_user` FOREIGN KEY (`user_id`) REFERENCES `users`(`id`))",
+		"CREATE UNIQUE INDEX IF NOT EXISTS `idx_api_tokens_hash` ON `api_tokens`(`hash`)",
+		"CREATE INDEX IF NOT EXISTS `idx_api_tokens_user_id` ON `api_tokens`(`user_id`)",
+		"CREATE INDEX IF NOT EXISTS `idx_api_tokens_family` ON `api_tokens`(`family`)",
+		"CREATE INDEX IF NOT EXISTS `idx_api_tokens_deleted_at` ON `api_tokens`(`deleted_at`)",
+	),
+	Down: exec("DROP TABLE IF EXISTS `api_tokens`"),
+}
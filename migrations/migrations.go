@@ -0,0 +1,261 @@
+package migrations
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Migration is one numbered schema change. Up and Down run inside a DB
+// transaction, so a failing step leaves the schema untouched.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+// all lists every migration in the order it must be applied
+var all = []Migration{
+	baseline,
+	rentalLifecycle,
+	stationSlots,
+	pricingAndLedger,
+	userRoles,
+	lockAuditLogs,
+	stationHeartbeat,
+	deviceSecrets,
+	dispenseDeadline,
+	returnDetection,
+	apiTokens,
+}
+
+// State is a migration together with whether it has been applied
+type State struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// schemaMigration is a row of the schema_migrations table
+type schemaMigration struct {
+	Version   int `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+func (schemaMigration) TableName() string { return "schema_migrations" }
+
+// migrationLock is the single row of schema_migrations_lock held while migrating
+type migrationLock struct {
+	ID       int `gorm:"primaryKey;autoIncrement:false"`
+	Holder   string
+	LockedAt time.Time
+}
+
+func (migrationLock) TableName() string { return "schema_migrations_lock" }
+
+// staleLockAfter is how long a lock may be held before another runner takes it over
+const staleLockAfter = 15 * time.Minute
+
+// ErrLocked is returned when another process is migrating the database
+var ErrLocked = errors.New("database is being migrated by another process")
+
+// Latest returns the version the code expects the database to be at
+func Latest() int {
+	return all[len(all)-1].Version
+}
+
+// Status returns every known migration and whether it has been applied
+func Status(db *gorm.DB) ([]State, error) {
+	applied, err := appliedVersions(db)
+	if err != nil {
+		return nil, err
+	}
+
+	states := make([]State, 0, len(all))
+	for _, m := range all {
+		row, ok := applied[m.Version]
+		states = append(states, State{Migration: m, Applied: ok, AppliedAt: row.AppliedAt})
+	}
+	return states, nil
+}
+
+// Pending returns the migrations that have not been applied yet
+func Pending(db *gorm.DB) ([]Migration, error) {
+	states, err := Status(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []Migration
+	for _, s := range states {
+		if !s.Applied {
+			pending = append(pending, s.Migration)
+		}
+	}
+	return pending, nil
+}
+
+// CurrentVersion returns the highest applied version, 0 for an empty database
+func CurrentVersion(db *gorm.DB) (int, error) {
+	applied, err := appliedVersions(db)
+	if err != nil {
+		return 0, err
+	}
+	current := 0
+	for version := range applied {
+		if version > current {
+			current = version
+		}
+	}
+	return current, nil
+}
+
+// Up applies every pending migration in order and returns the ones it applied
+func Up(db *gorm.DB) ([]Migration, error) {
+	var done []Migration
+	err := withLock(db, func() error {
+		pending, err := Pending(db)
+		if err != nil {
+			return err
+		}
+		for _, m := range pending {
+			err := db.Transaction(func(tx *gorm.DB) error {
+				if err := m.Up(tx); err != nil {
+					return err
+				}
+				return tx.Create(&schemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+			})
+			if err != nil {
+				return fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+			}
+			done = append(done, m)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Down reverts the last steps applied migrations, newest first, and returns the ones it reverted
+func Down(db *gorm.DB, steps int) ([]Migration, error) {
+	var done []Migration
+	err := withLock(db, func() error {
+		states, err := Status(db)
+		if err != nil {
+			return err
+		}
+		sort.Slice(states, func(i, j int) bool { return states[i].Version > states[j].Version })
+
+		for _, s := range states {
+			if len(done) == steps {
+				break
+			}
+			if !s.Applied {
+				continue
+			}
+			m := s.Migration
+			err := db.Transaction(func(tx *gorm.DB) error {
+				if err := m.Down(tx); err != nil {
+					return err
+				}
+				return tx.Delete(&schemaMigration{}, m.Version).Error
+			})
+			if err != nil {
+				return fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+			}
+			done = append(done, m)
+		}
+		return nil
+	})
+	return done, err
+}
+
+func appliedVersions(db *gorm.DB) (map[int]schemaMigration, error) {
+	if err := db.Exec("CREATE TABLE IF NOT EXISTS `schema_migrations` (`version` integer PRIMARY KEY,`name` text,`applied_at` datetime)").Error; err != nil {
+		return nil, err
+	}
+	var rows []schemaMigration
+	if err := db.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	applied := make(map[int]schemaMigration, len(rows))
+	for _, row := range rows {
+		applied[row.Version] = row
+	}
+	return applied, nil
+}
+
+// withLock runs fn while holding the schema_migrations_lock row, so two
+// instances starting at the same time can't migrate concurrently
+func withLock(db *gorm.DB, fn func() error) error {
+	if err := db.Exec("CREATE TABLE IF NOT EXISTS `schema_migrations_lock` (`id` integer PRIMARY KEY,`holder` text,`locked_at` datetime)").Error; err != nil {
+		return err
+	}
+
+	hostname, _ := os.Hostname()
+	lock := migrationLock{ID: 1, Holder: fmt.Sprintf("%s/%d", hostname, os.Getpid()), LockedAt: time.Now()}
+
+	// Take over locks left behind by a runner that crashed
+	db.Where("id = ? AND locked_at < ?", 1, time.Now().Add(-staleLockAfter)).Delete(&migrationLock{})
+
+	if err := db.Create(&lock).Error; err != nil {
+		var holder migrationLock
+		if db.First(&holder, 1).Error == nil {
+			return fmt.Errorf("%w (%s since %s)", ErrLocked, holder.Holder, holder.LockedAt.Format(time.RFC3339))
+		}
+		return err
+	}
+	defer db.Delete(&migrationLock{}, 1)
+
+	return fn()
+}
+
+// exec returns a step that runs the statements in order
+func exec(statements ...string) func(*gorm.DB) error {
+	return func(tx *gorm.DB) error {
+		for _, stmt := range statements {
+			if err := tx.Exec(stmt).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// steps chains several steps into one
+func steps(fns ...func(*gorm.DB) error) func(*gorm.DB) error {
+	return func(tx *gorm.DB) error {
+		for _, fn := range fns {
+			if err := fn(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// addColumn adds a column unless it already exists, which is the case for
+// databases that were created by the old AutoMigrate on startup
+func addColumn(table, column, definition string) func(*gorm.DB) error {
+	return func(tx *gorm.DB) error {
+		if tx.Migrator().HasColumn(table, column) {
+			return nil
+		}
+		return tx.Exec(fmt.Sprintf("ALTER TABLE `%s` ADD COLUMN `%s` %s", table, column, definition)).Error
+	}
+}
+
+// dropColumn removes a column if it exists
+func dropColumn(table, column string) func(*gorm.DB) error {
+	return func(tx *gorm.DB) error {
+		if !tx.Migrator().HasColumn(table, column) {
+			return nil
+		}
+		return tx.Exec(fmt.Sprintf("ALTER TABLE `%s` DROP COLUMN `%s`", table, column)).Error
+	}
+}
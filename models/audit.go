@@ -0,0 +1,25 @@
+package models
+
+import "gorm.io/gorm"
+
+// Lock command outcomes recorded in the audit log
+const (
+	AuditSucceeded   = "succeeded"
+	AuditFailed      = "failed"
+	AuditRateLimited = "rate_limited" // Refused before reaching the station
+)
+
+// LockAuditLog records one lock command issued by staff from the console
+type LockAuditLog struct {
+	gorm.Model
+	StationID  uint `gorm:"index"`
+	Station    PowerbankStation
+	SlotIndex  int
+	UserID     uint
+	User       User
+	Action     string // open, close or status
+	Reason     string
+	Result     string // AuditSucceeded, AuditFailed or AuditRateLimited
+	LockStatus string // Reported lock state for status commands
+	Error      string
+}
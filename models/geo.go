@@ -0,0 +1,75 @@
+package models
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"gorm.io/gorm"
+)
+
+// earthRadiusKm is the mean radius of the Earth
+const earthRadiusKm = 6371.0
+
+// NearbyStation is a station with its distance from the user
+type NearbyStation struct {
+	PowerbankStation
+	DistanceKm float64
+}
+
+// DistanceText renders the distance for display, e.g. "350 m" or "1.2 km"
+func (s NearbyStation) DistanceText() string {
+	if s.DistanceKm < 1 {
+		return fmt.Sprintf("%d m", int(math.Round(s.DistanceKm*1000)))
+	}
+	return fmt.Sprintf("%.1f km", s.DistanceKm)
+}
+
+// DistanceKm is the great-circle distance between two points, using the haversine formula
+func DistanceKm(lat1, lng1, lat2, lng2 float64) float64 {
+	dLat := radians(lat2 - lat1)
+	dLng := radians(lng2 - lng1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(radians(lat1))*math.Cos(radians(lat2))*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+func radians(deg float64) float64 {
+	return deg * math.Pi / 180
+}
+
+// Near keeps stations inside the bounding box of a circle around the point.
+// The corners of the box are farther than radiusKm, so filter the loaded
+// stations on their exact distance afterwards, see ByDistance.
+func Near(lat, lng, radiusKm float64) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		dLat := radiusKm / earthRadiusKm * 180 / math.Pi
+		db = db.Where("powerbank_stations.latitude BETWEEN ? AND ?", lat-dLat, lat+dLat)
+
+		// Near the poles or across the date line every longitude may be in range
+		cos := math.Cos(radians(lat))
+		if cos < 0.01 {
+			return db
+		}
+		dLng := dLat / cos
+		if lng-dLng < -180 || lng+dLng > 180 {
+			return db
+		}
+		return db.Where("powerbank_stations.longitude BETWEEN ? AND ?", lng-dLng, lng+dLng)
+	}
+}
+
+// ByDistance pairs every station with its distance from the point, closest first
+func ByDistance(stations []PowerbankStation, lat, lng float64) []NearbyStation {
+	nearby := make([]NearbyStation, len(stations))
+	for i, station := range stations {
+		nearby[i] = NearbyStation{
+			PowerbankStation: station,
+			DistanceKm:       DistanceKm(lat, lng, station.Latitude, station.Longitude),
+		}
+	}
+	sort.SliceStable(nearby, func(i, j int) bool {
+		return nearby[i].DistanceKm < nearby[j].DistanceKm
+	})
+	return nearby
+}
@@ -0,0 +1,79 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// StationOfflineAfter is how long a station may go without a heartbeat
+// before it counts as offline. Set from config at startup.
+var StationOfflineAfter = 90 * time.Second
+
+// onlineSQL is true for stations that sent a heartbeat recently. Simulated
+// stations have no hardware to report in, so they are always online.
+const onlineSQL = "(powerbank_stations.lock_driver = '" + LockDriverSimulator + "' OR powerbank_stations.last_seen_at >= ?)"
+
+// IsOnline keeps stations that can be reached right now
+func IsOnline(db *gorm.DB) *gorm.DB {
+	return db.Where(onlineSQL, onlineSince())
+}
+
+// NewDeviceSecret generates a random secret for a station cabinet
+func NewDeviceSecret() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func onlineSince() time.Time {
+	return time.Now().Add(-StationOfflineAfter)
+}
+
+// SlotReport is the state of one slot as sent in a heartbeat
+type SlotReport struct {
+	Slot   int    `json:"slot"`
+	Lock   string `json:"lock"` // SlotLocked or SlotUnlocked
+	Faulty bool   `json:"faulty"`
+}
+
+// Heartbeat is the periodic health report a station cabinet posts
+type Heartbeat struct {
+	StationID uint         `json:"-"` // Taken from the authenticated request
+	Firmware  string       `json:"firmware"`
+	Uptime    int64        `json:"uptime"` // Seconds since boot
+	RSSI      int          `json:"rssi"`   // WiFi signal strength in dBm
+	Slots     []SlotReport `json:"slots"`
+}
+
+// RecordHeartbeat stores a heartbeat on the station and its slots
+func RecordHeartbeat(db *gorm.DB, hb Heartbeat, at time.Time) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&PowerbankStation{}).Where("id = ?", hb.StationID).Updates(map[string]interface{}{
+			"last_seen_at":     at,
+			"firmware_version": hb.Firmware,
+			"uptime_seconds":   hb.Uptime,
+			"rssi":             hb.RSSI,
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		for _, report := range hb.Slots {
+			if report.Lock != SlotLocked && report.Lock != SlotUnlocked {
+				continue
+			}
+			err := tx.Model(&StationSlot{}).
+				Where("station_id = ? AND slot_index = ?", hb.StationID, report.Slot).
+				Updates(map[string]interface{}{"lock_state": report.Lock, "faulty": report.Faulty}).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		// A slot turning faulty changes what can be rented
+		return SyncStationStock(tx, hb.StationID)
+	})
+}
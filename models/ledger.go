@@ -0,0 +1,85 @@
+package models
+
+import "gorm.io/gorm"
+
+// Ledger entry kinds
+const (
+	LedgerDeposit = "deposit"  // Paid up front through Midtrans
+	LedgerCharge  = "charge"   // Usage charge settled against the deposit
+	LedgerRefund  = "refund"   // Unused deposit sent back through Midtrans
+	LedgerLateFee = "late_fee" // Accrued while a rental is past its allowance
+	LedgerForfeit = "forfeit"  // Charged when a powerbank is declared lost
+)
+
+// Ledger entry statuses
+const (
+	LedgerSucceeded   = "succeeded"
+	LedgerFailed      = "failed"
+	LedgerOutstanding = "outstanding" // Owed by the user, not collected yet
+)
+
+// LedgerEntry records one money movement of a rental. Amounts are in IDR
+// and always positive, the Kind gives the direction.
+type LedgerEntry struct {
+	gorm.Model
+	TransactionID uint `gorm:"index"`
+	Kind          string
+	Amount        int64
+	Status        string
+	Reference     string // Midtrans order ID or refund key
+	Note          string
+}
+
+// Refunded sums the successful refunds of a transaction loaded with its Ledger
+func (t Transaction) Refunded() int64 {
+	var total int64
+	for _, entry := range t.Ledger {
+		if entry.Kind == LedgerRefund && entry.Status == LedgerSucceeded {
+			total += entry.Amount
+		}
+	}
+	return total
+}
+
+// Penalties sums the late fees and forfeiture of a transaction loaded with its Ledger
+func (t Transaction) Penalties() int64 {
+	var total int64
+	for _, entry := range t.Ledger {
+		if entry.Kind == LedgerLateFee || entry.Kind == LedgerForfeit {
+			total += entry.Amount
+		}
+	}
+	return total
+}
+
+// Settled reports whether the final charge of a transaction loaded with its Ledger was booked
+func (t Transaction) Settled() bool {
+	for _, entry := range t.Ledger {
+		if entry.Kind == LedgerCharge {
+			return true
+		}
+	}
+	return false
+}
+
+// RefundRetrying sums the refunds of a transaction loaded with its Ledger
+// that failed and haven't gone through on a later attempt yet
+func (t Transaction) RefundRetrying() int64 {
+	failed := make(map[string]int64)
+	for _, entry := range t.Ledger {
+		if entry.Kind != LedgerRefund {
+			continue
+		}
+		switch entry.Status {
+		case LedgerFailed:
+			failed[entry.Reference] = entry.Amount
+		case LedgerSucceeded:
+			failed[entry.Reference] = 0
+		}
+	}
+	var total int64
+	for _, amount := range failed {
+		total += amount
+	}
+	return total
+}
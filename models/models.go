@@ -11,10 +11,38 @@ type User struct {
 	gorm.Model
 	Username     string `gorm:"uniqueIndex;not null"`
 	Email        string `gorm:"uniqueIndex;not null"`
-	Password     string `gorm:"not null"` // Hashed
+	Password     string `gorm:"not null"`              // Hashed
+	Role         string `gorm:"not null;default:user"` // RoleUser, RoleOperator or RoleAdmin
 	Transactions []Transaction
 }
 
+// User roles
+const (
+	RoleUser     = "user"
+	RoleOperator = "operator" // Runs stations in the field
+	RoleAdmin    = "admin"    // Manages stations, powerbanks and users
+)
+
+// HasRole reports whether the user has one of the given roles. Admins pass every check.
+func (u User) HasRole(roles ...string) bool {
+	if u.Role == RoleAdmin {
+		return true
+	}
+	for _, role := range roles {
+		if u.Role == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Lock driver names stored on PowerbankStation.LockDriver
+const (
+	LockDriverHTTP      = "http"
+	LockDriverSimulator = "simulator"
+	LockDriverWebSocket = "websocket" // Station keeps a connection open to the server, see esp32.Hub
+)
+
 // PowerbankStation stores location and capacity
 type PowerbankStation struct {
 	gorm.Model
@@ -22,10 +50,26 @@ type PowerbankStation struct {
 	Latitude      float64
 	Longitude     float64
 	Capacity      int
-	PowerbankLeft int
+	PowerbankLeft int    // Materialized count of available units, see SyncStationStock
 	IPAddress     string // For ESP32 communication
+	LockDriver    string `gorm:"default:http"` // LockDriverHTTP, LockDriverSimulator or LockDriverWebSocket
+	DeviceSecret  string `json:"-"`            // Shared with the cabinet firmware, signs lock commands, heartbeats, slot events and the WebSocket connection
+
+	// Last heartbeat, see RecordHeartbeat
+	LastSeenAt      *time.Time
+	FirmwareVersion string
+	UptimeSeconds   int64
+	RSSI            int `gorm:"column:rssi"`
+
 	// FIX: Explicitly specify that the Foreign Key in the Powerbank struct is 'CurrentStationID'
-	Powerbanks []Powerbank `gorm:"foreignKey:CurrentStationID"`
+	Powerbanks []Powerbank   `gorm:"foreignKey:CurrentStationID"`
+	Slots      []StationSlot `gorm:"foreignKey:StationID"`
+
+	// Computed from slots and Powerbank rows when loaded with the WithStock scope
+	AvailableCount int  `gorm:"->;-:migration"`
+	DockedCount    int  `gorm:"->;-:migration"`
+	EmptySlots     int  `gorm:"->;-:migration"`
+	Online         bool `gorm:"->;-:migration"` // See IsOnline
 }
 
 // Powerbank represents the physical unit
@@ -33,7 +77,7 @@ type Powerbank struct {
 	gorm.Model
 	PowerbankCode    string `gorm:"uniqueIndex"`
 	Capacity         int    // e.g., 10000mAh
-	Status           string // "Available", "Rented"
+	Status           string // PowerbankAvailable, PowerbankRented, PowerbankLost, PowerbankMissing
 	CurrentStationID *uint
 	CurrentStation   *PowerbankStation `gorm:"foreignKey:CurrentStationID"`
 }
@@ -47,11 +91,22 @@ type Transaction struct {
 	Powerbank                Powerbank
 	PowerbankStationOriginID uint
 	PowerbankStationOrigin   PowerbankStation `gorm:"foreignKey:PowerbankStationOriginID"`
+	OriginSlotIndex          *int             // Slot the powerbank was dispensed from
 	PowerbankStationReturnID *uint
 	PowerbankStationReturn   *PowerbankStation `gorm:"foreignKey:PowerbankStationReturnID"`
-	Status                   string            // "Pending", "Ongoing", "Returned", "Failed"
-	DateReturned             *time.Time
-	OrderID                  string `gorm:"uniqueIndex"` // Midtrans Order ID
-	PaymentToken             string // Midtrans Transaction ID
+	ReturnSlotIndex          *int              // Slot the powerbank was returned to
+	Status                   TransactionStatus // Only changed through Transition
+	DispenseDeadline         *time.Time        // A rental still Dispensing by then is rolled back
+	DateRented               *time.Time        // When the powerbank was taken out of the cabinet
+	ReturnDeadline           *time.Time        // A return still Returning by then is cancelled
+	DateReturned             *time.Time        // When the cabinet detected the powerbank
+	TariffPlanID             *uint             // Plan the rental is priced with
+	OrderID                  string            `gorm:"uniqueIndex"` // Midtrans Order ID
+	GrossAmount              int64             // Deposit paid through Midtrans, in IDR
+	FinalAmount              int64             // Usage-based charge calculated at return, in IDR
+	PaymentToken             string            // Midtrans Transaction ID
 	PaymentRedirectURL       string
+	ReviewNote               string // Set when a cabinet reported something unexpected for this rental
+	StatusHistory            []TransactionStatusChange
+	Ledger                   []LedgerEntry
 }
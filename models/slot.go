@@ -0,0 +1,99 @@
+package models
+
+import "gorm.io/gorm"
+
+// Slot lock states, as last reported by the cabinet
+const (
+	SlotLocked   = "locked"
+	SlotUnlocked = "unlocked"
+)
+
+// StationSlot is one physical bay of a station cabinet. A slot holds at most
+// one powerbank and is addressed by its Index in lock commands.
+type StationSlot struct {
+	gorm.Model
+	StationID   uint       `gorm:"uniqueIndex:idx_station_slot;not null"`
+	Index       int        `gorm:"column:slot_index;uniqueIndex:idx_station_slot;not null"` // 1-based, as printed on the cabinet
+	PowerbankID *uint      `gorm:"uniqueIndex"`                                             // nil when the slot is empty
+	Powerbank   *Powerbank `gorm:"foreignKey:PowerbankID"`
+	LockState   string     `gorm:"default:locked"`
+	Faulty      bool       // Faulty slots are skipped for both rentals and returns
+}
+
+// EnsureSlots creates the missing slots of every station up to its capacity,
+// docks any powerbank that sits at a station without a slot, and refreshes
+// the station's stock counter.
+func EnsureSlots(db *gorm.DB) error {
+	var stations []PowerbankStation
+	if err := db.Preload("Slots").Find(&stations).Error; err != nil {
+		return err
+	}
+
+	for _, station := range stations {
+		taken := make(map[int]bool)
+		docked := make(map[uint]bool)
+		for _, slot := range station.Slots {
+			taken[slot.Index] = true
+			if slot.PowerbankID != nil {
+				docked[*slot.PowerbankID] = true
+			}
+		}
+
+		for i := 1; i <= station.Capacity; i++ {
+			if taken[i] {
+				continue
+			}
+			if err := db.Create(&StationSlot{StationID: station.ID, Index: i, LockState: SlotLocked}).Error; err != nil {
+				return err
+			}
+		}
+
+		var units []Powerbank
+		if err := db.Where("current_station_id = ?", station.ID).Order("id").Find(&units).Error; err != nil {
+			return err
+		}
+		for _, unit := range units {
+			if docked[unit.ID] {
+				continue
+			}
+			var slot StationSlot
+			err := db.Where("station_id = ? AND powerbank_id IS NULL", station.ID).Order("slot_index").First(&slot).Error
+			if err != nil {
+				break // Station is full, reconcile will report it
+			}
+			if err := db.Model(&slot).Update("powerbank_id", unit.ID).Error; err != nil {
+				return err
+			}
+		}
+
+		if err := SyncStationStock(db, station.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReserveEmptySlot assigns the powerbank to the first free, working slot of
+// the station. The update only succeeds if the slot is still empty. Returns
+// gorm.ErrRecordNotFound if the station has no such slot left.
+func ReserveEmptySlot(txDB *gorm.DB, stationID uint, powerbankID uint) (StationSlot, error) {
+	var candidates []StationSlot
+	if err := txDB.Where("station_id = ? AND powerbank_id IS NULL AND faulty = ?", stationID, false).
+		Order("slot_index").Find(&candidates).Error; err != nil {
+		return StationSlot{}, err
+	}
+
+	for _, slot := range candidates {
+		result := txDB.Model(&StationSlot{}).
+			Where("id = ? AND powerbank_id IS NULL", slot.ID).
+			Update("powerbank_id", powerbankID)
+		if result.Error != nil {
+			return StationSlot{}, result.Error
+		}
+		if result.RowsAffected == 1 {
+			slot.PowerbankID = &powerbankID
+			return slot, nil
+		}
+	}
+	return StationSlot{}, gorm.ErrRecordNotFound
+}
@@ -0,0 +1,95 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// TransactionStatus is the lifecycle state of a rental
+type TransactionStatus string
+
+const (
+	StatusPending    TransactionStatus = "Pending"    // Waiting for payment
+	StatusPaid       TransactionStatus = "Paid"       // Payment confirmed, no unit assigned yet
+	StatusDispensing TransactionStatus = "Dispensing" // Unit assigned, cabinet is releasing it
+	StatusOngoing    TransactionStatus = "Ongoing"    // User has the powerbank
+	StatusReturning  TransactionStatus = "Returning"  // Slot reserved and opened, waiting for the cabinet to detect the unit
+	StatusReturned   TransactionStatus = "Returned"
+	StatusFailed     TransactionStatus = "Failed"
+	StatusRefunded   TransactionStatus = "Refunded"
+	StatusLost       TransactionStatus = "Lost"
+	StatusCancelled  TransactionStatus = "Cancelled"
+)
+
+// transitions lists every legal status change. Statuses without an entry are final.
+var transitions = map[TransactionStatus][]TransactionStatus{
+	StatusPending:    {StatusPaid, StatusFailed, StatusCancelled},
+	StatusPaid:       {StatusDispensing, StatusFailed, StatusRefunded},
+	StatusDispensing: {StatusOngoing, StatusFailed, StatusRefunded},
+	StatusOngoing:    {StatusReturning, StatusLost},
+	StatusReturning:  {StatusReturned, StatusOngoing},
+	StatusFailed:     {StatusRefunded},
+}
+
+var (
+	// ErrIllegalTransition is returned when the transition table forbids a change
+	ErrIllegalTransition = errors.New("illegal transaction status transition")
+	// ErrStaleTransition is returned when the stored status changed before the update ran
+	ErrStaleTransition = errors.New("transaction status changed concurrently")
+)
+
+// CanTransitionTo reports whether the transition table allows s -> to
+func (s TransactionStatus) CanTransitionTo(to TransactionStatus) bool {
+	for _, allowed := range transitions[s] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// TransactionStatusChange is one row of a transaction's status history
+type TransactionStatusChange struct {
+	gorm.Model
+	TransactionID uint `gorm:"index"`
+	From          TransactionStatus
+	To            TransactionStatus
+	Reason        string
+}
+
+// Transition moves tx to the given status and records the change in the
+// history table. The update only applies if the stored status still equals
+// tx.Status, so two callers racing on the same transaction can't both win.
+func Transition(db *gorm.DB, tx *Transaction, to TransactionStatus, reason string) error {
+	from := tx.Status
+	if !from.CanTransitionTo(to) {
+		return fmt.Errorf("%w: transaction %d %s -> %s", ErrIllegalTransition, tx.ID, from, to)
+	}
+
+	err := db.Transaction(func(dbTx *gorm.DB) error {
+		result := dbTx.Model(&Transaction{}).
+			Where("id = ? AND status = ?", tx.ID, from).
+			Update("status", to)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return fmt.Errorf("%w: transaction %d is no longer %s", ErrStaleTransition, tx.ID, from)
+		}
+
+		return dbTx.Create(&TransactionStatusChange{
+			TransactionID: tx.ID,
+			From:          from,
+			To:            to,
+			Reason:        reason,
+		}).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	tx.Status = to
+	return nil
+}
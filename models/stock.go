@@ -0,0 +1,45 @@
+package models
+
+import "gorm.io/gorm"
+
+// Powerbank statuses
+const (
+	PowerbankAvailable = "Available"
+	PowerbankRented    = "Rented"
+	PowerbankLost      = "Lost"    // Not returned in time, see the overdue worker
+	PowerbankMissing   = "Missing" // Taken out of a slot no rental was dispensing from
+)
+
+// Stock counts derived from the slots of a station and the powerbanks docked in them
+const (
+	availableCountSQL = "(SELECT COUNT(*) FROM station_slots JOIN powerbanks ON powerbanks.id = station_slots.powerbank_id WHERE station_slots.station_id = powerbank_stations.id AND station_slots.faulty = false AND station_slots.deleted_at IS NULL AND powerbanks.status = 'Available' AND powerbanks.deleted_at IS NULL)"
+	dockedCountSQL    = "(SELECT COUNT(*) FROM powerbanks WHERE powerbanks.current_station_id = powerbank_stations.id AND powerbanks.deleted_at IS NULL)"
+	emptySlotsSQL     = "(SELECT COUNT(*) FROM station_slots WHERE station_slots.station_id = powerbank_stations.id AND station_slots.powerbank_id IS NULL AND station_slots.faulty = false AND station_slots.deleted_at IS NULL)"
+)
+
+// WithStock fills AvailableCount, DockedCount, EmptySlots and Online on loaded stations
+func WithStock(db *gorm.DB) *gorm.DB {
+	return db.Select("powerbank_stations.*, "+
+		availableCountSQL+" AS available_count, "+
+		dockedCountSQL+" AS docked_count, "+
+		emptySlotsSQL+" AS empty_slots, "+
+		onlineSQL+" AS online", onlineSince())
+}
+
+// HasAvailable keeps stations with at least one powerbank ready to rent
+func HasAvailable(db *gorm.DB) *gorm.DB {
+	return db.Where(availableCountSQL + " > 0")
+}
+
+// HasEmptySlot keeps stations with a working slot free for a returned powerbank
+func HasEmptySlot(db *gorm.DB) *gorm.DB {
+	return db.Where(emptySlotsSQL + " > 0")
+}
+
+// SyncStationStock rewrites the materialized PowerbankLeft counter from the
+// slots and Powerbank rows. Call it in the same DB transaction that moves a unit.
+func SyncStationStock(db *gorm.DB, stationID uint) error {
+	return db.Model(&PowerbankStation{}).
+		Where("id = ?", stationID).
+		Update("powerbank_left", gorm.Expr(availableCountSQL)).Error
+}
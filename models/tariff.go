@@ -0,0 +1,20 @@
+package models
+
+import "gorm.io/gorm"
+
+// TariffPlan describes how a rental is priced. A plan with StationID set
+// overrides the default plan for that station. All amounts are in IDR.
+type TariffPlan struct {
+	gorm.Model
+	Name           string
+	StationID      *uint `gorm:"index"` // nil for plans that are not station overrides
+	IsDefault      bool  // Used for stations without an override
+	UnlockFee      int64
+	HourlyRate     int64   // Charged per started hour
+	DailyCap       int64   // Maximum charged per started 24 hours, 0 for no cap
+	PeakMultiplier float64 // Applied to HourlyRate for hours starting in the peak window
+	PeakStartHour  int     // Local hour the peak window starts, inclusive
+	PeakEndHour    int     // Local hour the peak window ends, exclusive
+	LateFeePerHour int64   // Charged per started hour past the rental allowance
+	ForfeitFee     int64   // Charged when the powerbank is declared lost
+}
@@ -0,0 +1,28 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// API token kinds
+const (
+	TokenAccess  = "access"  // Sent as a bearer token with every API request
+	TokenRefresh = "refresh" // Exchanged for a new pair once the access token expired
+)
+
+// APIToken is an opaque token issued to an API client, see auth.Service.
+// Only the SHA-256 of the token is stored. The access and refresh token of
+// a login, and every pair refreshed from them, share a Family so that
+// logging out revokes all of them.
+type APIToken struct {
+	gorm.Model
+	UserID    uint `gorm:"index"`
+	User      User
+	Kind      string `gorm:"not null"` // TokenAccess or TokenRefresh
+	Hash      string `gorm:"uniqueIndex;not null"`
+	Family    string `gorm:"index;not null"`
+	ExpiresAt time.Time
+	RevokedAt *time.Time
+}
@@ -0,0 +1,152 @@
+package overdue
+
+import (
+	"context"
+	"fmt"
+	"kbt-cuy/models"
+	"kbt-cuy/pricing"
+	"log"
+	"math"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Worker periodically looks at ongoing rentals, books late fees for the
+// ones past their allowance and declares the powerbank lost after LostAfter
+type Worker struct {
+	DB        *gorm.DB
+	Pricing   *pricing.Engine
+	Allowance time.Duration
+	LostAfter time.Duration
+	Interval  time.Duration
+}
+
+// Report summarises one scan
+type Report struct {
+	Overdue  int // Rentals past their allowance
+	LateFees int // Rentals that got a new late fee entry
+	Lost     int // Rentals declared lost
+}
+
+// Run scans once immediately and then every Interval until ctx is cancelled
+func (w *Worker) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+
+	for {
+		report, err := w.Scan(time.Now())
+		if err != nil {
+			log.Printf("[OVERDUE] Scan failed: %v", err)
+		} else if report.LateFees > 0 || report.Lost > 0 {
+			log.Printf("[OVERDUE] %d overdue, %d late fees booked, %d declared lost", report.Overdue, report.LateFees, report.Lost)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Scan processes every ongoing rental that started before now - Allowance
+func (w *Worker) Scan(now time.Time) (Report, error) {
+	var report Report
+
+	var rentals []models.Transaction
+	if err := w.DB.Where("status = ? AND COALESCE(date_rented, created_at) < ?", models.StatusOngoing, now.Add(-w.Allowance)).
+		Find(&rentals).Error; err != nil {
+		return report, err
+	}
+
+	for i := range rentals {
+		tx := &rentals[i]
+		report.Overdue++
+
+		plan, err := w.Pricing.PlanForTransaction(*tx)
+		if err != nil {
+			log.Printf("[OVERDUE] Transaction %d: %v", tx.ID, err)
+			continue
+		}
+
+		elapsed := now.Sub(rentedAt(*tx))
+		if elapsed >= w.LostAfter {
+			if err := w.markLost(tx, plan, now); err != nil {
+				log.Printf("[OVERDUE] Transaction %d: %v", tx.ID, err)
+				continue
+			}
+			report.Lost++
+			continue
+		}
+
+		booked, err := accrueLateFee(w.DB, *tx, plan, elapsed-w.Allowance)
+		if err != nil {
+			log.Printf("[OVERDUE] Transaction %d: %v", tx.ID, err)
+			continue
+		}
+		if booked {
+			report.LateFees++
+		}
+	}
+	return report, nil
+}
+
+// markLost closes the rental as lost, books the remaining late fees up to
+// the lost threshold and the forfeiture charge
+func (w *Worker) markLost(tx *models.Transaction, plan models.TariffPlan, now time.Time) error {
+	return w.DB.Transaction(func(dbTx *gorm.DB) error {
+		if _, err := accrueLateFee(dbTx, *tx, plan, w.LostAfter-w.Allowance); err != nil {
+			return err
+		}
+		if err := models.Transition(dbTx, tx, models.StatusLost, fmt.Sprintf("not returned after %s", w.LostAfter)); err != nil {
+			return err
+		}
+		if tx.PowerbankID != nil {
+			if err := dbTx.Model(&models.Powerbank{}).Where("id = ?", *tx.PowerbankID).
+				Update("status", models.PowerbankLost).Error; err != nil {
+				return err
+			}
+		}
+		return dbTx.Create(&models.LedgerEntry{
+			TransactionID: tx.ID,
+			Kind:          models.LedgerForfeit,
+			Amount:        plan.ForfeitFee,
+			Status:        models.LedgerOutstanding,
+			Reference:     tx.OrderID,
+			Note:          "powerbank declared lost on " + now.In(pricing.Location).Format("2006-01-02 15:04"),
+		}).Error
+	})
+}
+
+// accrueLateFee books the difference between the late fee owed for the
+// overdue time and what was already booked. Returns whether an entry was added.
+func accrueLateFee(db *gorm.DB, tx models.Transaction, plan models.TariffPlan, overdue time.Duration) (bool, error) {
+	due := pricing.LateFee(plan, overdue)
+
+	var booked int64
+	if err := db.Model(&models.LedgerEntry{}).
+		Where("transaction_id = ? AND kind = ?", tx.ID, models.LedgerLateFee).
+		Select("COALESCE(SUM(amount), 0)").Scan(&booked).Error; err != nil {
+		return false, err
+	}
+	if due <= booked {
+		return false, nil
+	}
+
+	return true, db.Create(&models.LedgerEntry{
+		TransactionID: tx.ID,
+		Kind:          models.LedgerLateFee,
+		Amount:        due - booked,
+		Status:        models.LedgerOutstanding,
+		Reference:     tx.OrderID,
+		Note:          fmt.Sprintf("%d hour(s) overdue", int(math.Ceil(overdue.Hours()))),
+	}).Error
+}
+
+func rentedAt(tx models.Transaction) time.Time {
+	if tx.DateRented != nil {
+		return *tx.DateRented
+	}
+	return tx.CreatedAt
+}
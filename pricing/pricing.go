@@ -0,0 +1,168 @@
+package pricing
+
+import (
+	"errors"
+	"fmt"
+	"kbt-cuy/models"
+	"math"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Location is the timezone peak hours are expressed in
+var Location = loadLocation()
+
+// StandardPlan is used when the database holds no tariff plan at all
+var StandardPlan = models.TariffPlan{
+	Name:           "Standard",
+	IsDefault:      true,
+	UnlockFee:      2000,
+	HourlyRate:     2000,
+	DailyCap:       10000,
+	PeakMultiplier: 1,
+	LateFeePerHour: 1000,
+	ForfeitFee:     150000,
+}
+
+// Engine looks up tariff plans and prices rentals
+type Engine struct {
+	DB *gorm.DB
+}
+
+// PlanFor returns the station's override plan, or the default plan
+func (e *Engine) PlanFor(stationID uint) (models.TariffPlan, error) {
+	var plan models.TariffPlan
+	err := e.DB.Where("station_id = ?", stationID).Order("id DESC").First(&plan).Error
+	if err == nil {
+		return plan, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return models.TariffPlan{}, err
+	}
+
+	err = e.DB.Where("is_default = ? AND station_id IS NULL", true).Order("id DESC").First(&plan).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return StandardPlan, nil
+	}
+	return plan, err
+}
+
+// PlanForTransaction returns the plan the rental was started under, falling
+// back to the origin station's current plan for older transactions
+func (e *Engine) PlanForTransaction(tx models.Transaction) (models.TariffPlan, error) {
+	if tx.TariffPlanID != nil {
+		var plan models.TariffPlan
+		if err := e.DB.Unscoped().First(&plan, *tx.TariffPlanID).Error; err == nil {
+			return plan, nil
+		}
+	}
+	return e.PlanFor(tx.PowerbankStationOriginID)
+}
+
+// Upfront is the amount paid when starting a rental at the given time: the
+// price of a full first day, so the final charge never exceeds it unless the
+// powerbank is kept longer than 24 hours
+func Upfront(plan models.TariffPlan, start time.Time) int64 {
+	return Charge(plan, start, start.Add(24*time.Hour))
+}
+
+// Charge prices a rental from start to end. Every started hour is billed at
+// the hourly rate (times the peak multiplier if the hour starts in the peak
+// window), the unlock fee is added once, and each started 24 hours is capped
+// at DailyCap.
+func Charge(plan models.TariffPlan, start, end time.Time) int64 {
+	hours := int(math.Ceil(end.Sub(start).Hours()))
+	if hours < 1 {
+		hours = 1
+	}
+
+	var total, day int64
+	day = plan.UnlockFee
+	for i := 0; i < hours; i++ {
+		if i > 0 && i%24 == 0 {
+			total += capDay(plan, day)
+			day = 0
+		}
+		day += hourRate(plan, start.Add(time.Duration(i)*time.Hour))
+	}
+	return total + capDay(plan, day)
+}
+
+// LateFee prices the time a rental ran past its allowance, per started hour
+func LateFee(plan models.TariffPlan, overdue time.Duration) int64 {
+	if overdue <= 0 {
+		return 0
+	}
+	return int64(math.Ceil(overdue.Hours())) * plan.LateFeePerHour
+}
+
+// Describe summarises a plan for display, e.g. "Rp 2.000 unlock + Rp 2.000/hour, max Rp 10.000/day"
+func Describe(plan models.TariffPlan) string {
+	parts := []string{}
+	if plan.UnlockFee > 0 {
+		parts = append(parts, FormatIDR(plan.UnlockFee)+" unlock")
+	}
+	parts = append(parts, FormatIDR(plan.HourlyRate)+"/hour")
+	desc := strings.Join(parts, " + ")
+	if plan.DailyCap > 0 {
+		desc += ", max " + FormatIDR(plan.DailyCap) + "/day"
+	}
+	if plan.PeakMultiplier > 1 && plan.PeakStartHour != plan.PeakEndHour {
+		desc += fmt.Sprintf(" (x%g from %02d:00 to %02d:00)", plan.PeakMultiplier, plan.PeakStartHour, plan.PeakEndHour)
+	}
+	return desc
+}
+
+// FormatIDR renders an amount the way Indonesian prices are written, e.g. "Rp 10.000"
+func FormatIDR(amount int64) string {
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	digits := fmt.Sprintf("%d", amount)
+	var b strings.Builder
+	for i, d := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			b.WriteByte('.')
+		}
+		b.WriteRune(d)
+	}
+	return "Rp " + sign + b.String()
+}
+
+func hourRate(plan models.TariffPlan, at time.Time) int64 {
+	if plan.PeakMultiplier <= 0 || !inPeak(plan, at) {
+		return plan.HourlyRate
+	}
+	return int64(math.Round(float64(plan.HourlyRate) * plan.PeakMultiplier))
+}
+
+func inPeak(plan models.TariffPlan, at time.Time) bool {
+	if plan.PeakStartHour == plan.PeakEndHour {
+		return false
+	}
+	hour := at.In(Location).Hour()
+	if plan.PeakStartHour < plan.PeakEndHour {
+		return hour >= plan.PeakStartHour && hour < plan.PeakEndHour
+	}
+	// Window wraps around midnight, e.g. 22:00 - 02:00
+	return hour >= plan.PeakStartHour || hour < plan.PeakEndHour
+}
+
+func capDay(plan models.TariffPlan, amount int64) int64 {
+	if plan.DailyCap > 0 && amount > plan.DailyCap {
+		return plan.DailyCap
+	}
+	return amount
+}
+
+func loadLocation() *time.Location {
+	loc, err := time.LoadLocation("Asia/Jakarta")
+	if err != nil {
+		return time.FixedZone("WIB", 7*60*60)
+	}
+	return loc
+}
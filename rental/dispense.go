@@ -0,0 +1,187 @@
+package rental
+
+import (
+	"errors"
+	"fmt"
+	"kbt-cuy/billing"
+	"kbt-cuy/esp32"
+	"kbt-cuy/models"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrNoDispense is returned for a removal at a slot no rental is being dispensed from
+var ErrNoDispense = errors.New("no rental is being dispensed from this slot")
+
+// DispenseDeadline is when a rental dispensed at the given time is rolled
+// back if its powerbank still hasn't been taken
+func (s *Service) DispenseDeadline(now time.Time) time.Time {
+	return now.Add(s.DispenseTimeout)
+}
+
+// ConfirmDispense starts the rental whose powerbank was taken out of the
+// reported slot and empties the slot. The rental is charged from the
+// reported time. A removal
+// no rental is waiting on is handled by unexpectedRemoval.
+func (s *Service) ConfirmDispense(ev esp32.Event) error {
+	var tx models.Transaction
+	err := s.DB.Preload("Powerbank").
+		Where("status = ? AND powerbank_station_origin_id = ? AND origin_slot_index = ?", models.StatusDispensing, ev.StationID, ev.Slot).
+		Order("id DESC").First(&tx).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		if err := s.unexpectedRemoval(ev); err != nil {
+			return err
+		}
+		return ErrNoDispense
+	}
+	if err != nil {
+		return err
+	}
+
+	// The user has whatever they took, so the rental starts either way
+	if ev.PowerbankCode != "" && ev.PowerbankCode != tx.Powerbank.PowerbankCode {
+		s.flag(tx.ID, fmt.Sprintf("powerbank %s was taken from slot %d, expected %s",
+			ev.PowerbankCode, ev.Slot, tx.Powerbank.PowerbankCode))
+	}
+
+	return s.DB.Transaction(func(dbTx *gorm.DB) error {
+		if err := models.Transition(dbTx, &tx, models.StatusOngoing, fmt.Sprintf("powerbank taken from slot %d", ev.Slot)); err != nil {
+			return err
+		}
+		if err := dbTx.Model(&tx).Update("date_rented", ev.At).Error; err != nil {
+			return err
+		}
+		// The slot held the unit while it was being dispensed
+		return dbTx.Model(&models.StationSlot{}).
+			Where("station_id = ? AND slot_index = ? AND powerbank_id = ?", ev.StationID, ev.Slot, *tx.PowerbankID).
+			Update("powerbank_id", nil).Error
+	})
+}
+
+// unexpectedRemoval takes the unit docked in the slot out of stock as
+// missing. It may have been taken after ExpireDispenses rolled its rental
+// back, so the last rolled back rental of the slot is flagged for review.
+func (s *Service) unexpectedRemoval(ev esp32.Event) error {
+	unit := "a powerbank"
+	if ev.PowerbankCode != "" {
+		unit = "powerbank " + ev.PowerbankCode
+	}
+	var rolledBack models.Transaction
+	if s.DB.Where("status IN ? AND powerbank_station_origin_id = ? AND origin_slot_index = ?",
+		[]models.TransactionStatus{models.StatusFailed, models.StatusRefunded}, ev.StationID, ev.Slot).
+		Order("id DESC").Limit(1).Find(&rolledBack).RowsAffected == 1 {
+		s.flag(rolledBack.ID, fmt.Sprintf("%s was taken from slot %d after the rental was rolled back", unit, ev.Slot))
+	}
+
+	return s.DB.Transaction(func(dbTx *gorm.DB) error {
+		var slot models.StationSlot
+		if dbTx.Where("station_id = ? AND slot_index = ? AND powerbank_id IS NOT NULL", ev.StationID, ev.Slot).
+			Limit(1).Find(&slot).RowsAffected == 0 {
+			return nil
+		}
+		// A slot reserved for a return holds a Rented unit, leave it be
+		pbID := *slot.PowerbankID
+		result := dbTx.Model(&models.Powerbank{}).
+			Where("id = ? AND status = ?", pbID, models.PowerbankAvailable).
+			Updates(map[string]interface{}{"status": models.PowerbankMissing, "current_station_id": nil})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		if err := dbTx.Model(&slot).Update("powerbank_id", nil).Error; err != nil {
+			return err
+		}
+		log.Printf("[RENTAL] Station %d slot %d: %s taken without a rental, powerbank %d marked missing",
+			ev.StationID, ev.Slot, unit, pbID)
+		return models.SyncStationStock(dbTx, ev.StationID)
+	})
+}
+
+// AbortDispense rolls back a rental whose powerbank never left the cabinet.
+// The unit is available again in its slot and the whole deposit is refunded,
+// a refund that fails is retried by Watch.
+func (s *Service) AbortDispense(tx *models.Transaction, reason string) error {
+	err := s.DB.Transaction(func(dbTx *gorm.DB) error {
+		if err := models.Transition(dbTx, tx, models.StatusFailed, reason); err != nil {
+			return err
+		}
+		if tx.PowerbankID == nil || tx.OriginSlotIndex == nil {
+			return nil
+		}
+
+		if err := dbTx.Model(&models.Powerbank{}).
+			Where("id = ? AND status = ?", *tx.PowerbankID, models.PowerbankRented).
+			Updates(map[string]interface{}{"status": models.PowerbankAvailable, "current_station_id": tx.PowerbankStationOriginID}).Error; err != nil {
+			return err
+		}
+		// Older rentals emptied the slot at payment, dock the unit back then
+		result := dbTx.Model(&models.StationSlot{}).
+			Where("station_id = ? AND slot_index = ? AND (powerbank_id IS NULL OR powerbank_id = ?)",
+				tx.PowerbankStationOriginID, *tx.OriginSlotIndex, *tx.PowerbankID).
+			Update("powerbank_id", *tx.PowerbankID)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			// EnsureSlots docks it elsewhere at the next start
+			log.Printf("[RENTAL] Transaction %d: slot %d was taken meanwhile, powerbank left undocked", tx.ID, *tx.OriginSlotIndex)
+		}
+		return models.SyncStationStock(dbTx, tx.PowerbankStationOriginID)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := s.Billing.RefundAll(*tx, "Powerbank was not dispensed"); err != nil {
+		return err
+	}
+	return models.Transition(s.DB, tx, models.StatusRefunded, "deposit refunded")
+}
+
+// ExpireDispenses aborts every rental still Dispensing after its deadline
+// and returns how many were rolled back
+func (s *Service) ExpireDispenses(now time.Time) (int, error) {
+	var rentals []models.Transaction
+	if err := s.DB.Where("status = ? AND COALESCE(dispense_deadline, created_at) < ?", models.StatusDispensing, now).
+		Find(&rentals).Error; err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	for i := range rentals {
+		tx := &rentals[i]
+		if err := s.AbortDispense(tx, "powerbank not taken before the dispense deadline"); err != nil {
+			if !errors.Is(err, models.ErrStaleTransition) {
+				log.Printf("[RENTAL] Transaction %d: rollback failed: %v", tx.ID, err)
+			}
+			continue
+		}
+		expired++
+	}
+	return expired, nil
+}
+
+// RetryRefunds sends the deposit back again for every Failed rental whose
+// refund didn't go through and returns how many were refunded
+func (s *Service) RetryRefunds(now time.Time) (int, error) {
+	var rentals []models.Transaction
+	if err := s.DB.Scopes(billing.RefundDue(now)).Where("status = ?", models.StatusFailed).
+		Find(&rentals).Error; err != nil {
+		return 0, err
+	}
+
+	refunded := 0
+	for i := range rentals {
+		tx := &rentals[i]
+		if err := s.Billing.RefundAll(*tx, "Powerbank was not dispensed"); err != nil {
+			continue
+		}
+		if err := models.Transition(s.DB, tx, models.StatusRefunded, "deposit refunded"); err != nil {
+			log.Printf("[RENTAL] Transaction %d: %v", tx.ID, err)
+			continue
+		}
+		refunded++
+	}
+	return refunded, nil
+}
@@ -0,0 +1,176 @@
+package rental
+
+import (
+	"kbt-cuy/billing"
+	"kbt-cuy/esp32"
+	"kbt-cuy/internal/testdb"
+	"kbt-cuy/models"
+	"kbt-cuy/pricing"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/midtrans/midtrans-go"
+	"github.com/midtrans/midtrans-go/coreapi"
+	"github.com/midtrans/midtrans-go/snap"
+)
+
+// fakeMidtrans takes every deposit, reports it settled and accepts refunds
+type fakeMidtrans struct {
+	mu      sync.Mutex
+	amounts map[string]int64
+	refunds []coreapi.RefundReq
+}
+
+func (m *fakeMidtrans) CreateTransaction(req *snap.Request) (*snap.Response, *midtrans.Error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.amounts[req.TransactionDetails.OrderID] = req.TransactionDetails.GrossAmt
+	return &snap.Response{Token: "token-" + req.TransactionDetails.OrderID}, nil
+}
+
+func (m *fakeMidtrans) CheckTransaction(orderID string) (*coreapi.TransactionStatusResponse, *midtrans.Error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return &coreapi.TransactionStatusResponse{
+		OrderID:           orderID,
+		GrossAmount:       strconv.FormatInt(m.amounts[orderID], 10) + ".00",
+		TransactionStatus: "settlement",
+	}, nil
+}
+
+func (m *fakeMidtrans) RefundTransaction(orderID string, req *coreapi.RefundReq) (*coreapi.RefundResponse, *midtrans.Error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.refunds = append(m.refunds, *req)
+	return &coreapi.RefundResponse{StatusCode: "200"}, nil
+}
+
+// waitForStatus polls the rental until it reaches the status or a second passed
+func waitForStatus(t *testing.T, rentals *Service, tx *models.Transaction, status models.TransactionStatus) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if rentals.DB.First(tx, tx.ID); tx.Status == status {
+			return
+		}
+	}
+	t.Fatalf("rental is %s, want %s", tx.Status, status)
+}
+
+func TestRentalPayDispenseReturn(t *testing.T) {
+	db := testdb.Open(t)
+	station := models.PowerbankStation{Name: "Station", Capacity: 3, LockDriver: models.LockDriverSimulator, DeviceSecret: "secret"}
+	mustCreate(t, db, &station)
+	for _, code := range []string{"PB-1", "PB-2"} {
+		mustCreate(t, db, &models.Powerbank{PowerbankCode: code, Capacity: 10000, Status: models.PowerbankAvailable, CurrentStationID: &station.ID})
+	}
+	if err := models.EnsureSlots(db); err != nil {
+		t.Fatal(err)
+	}
+	user := models.User{Username: "renter", Email: "renter@example.com", Password: "x"}
+	mustCreate(t, db, &user)
+
+	gateway := &fakeMidtrans{amounts: make(map[string]int64)}
+	simulator := esp32.NewSimulator()
+	simulator.Latency = 0
+	simulator.HoldFor = 0
+	simulator.ActAfter = 10 * time.Millisecond
+	locks := esp32.NewRegistry(models.LockDriverSimulator)
+	locks.Register(models.LockDriverSimulator, simulator)
+
+	rentals := &Service{
+		DB:              db,
+		Billing:         &billing.Service{DB: db, Midtrans: gateway},
+		Pricing:         &pricing.Engine{DB: db},
+		Locks:           locks,
+		Checkout:        gateway,
+		Payments:        gateway,
+		DispenseTimeout: time.Minute,
+		ReturnTimeout:   time.Minute,
+	}
+	simulator.Events = rentals.HandleEvent
+	simulator.Expect = rentals.Expected
+
+	// Pay: the poller finds the deposit settled and the slot is opened
+	tx, err := rentals.CreateOrder(user.ID, station.ID)
+	if err != nil {
+		t.Fatalf("CreateOrder: %v", err)
+	}
+	if err := rentals.SyncPayment(&tx); err != nil {
+		t.Fatalf("SyncPayment: %v", err)
+	}
+	if tx.Status != models.StatusDispensing {
+		t.Fatalf("paid rental is %s, want %s", tx.Status, models.StatusDispensing)
+	}
+
+	// Dispense: the simulated user takes the powerbank out
+	waitForStatus(t, rentals, &tx, models.StatusOngoing)
+	if tx.DateRented == nil {
+		t.Error("ongoing rental has no rental date")
+	}
+
+	// Return: a slot is reserved and the simulated user pushes the powerbank in
+	if _, err := rentals.StartReturn(user.ID, tx.ID, station.ID); err != nil {
+		t.Fatalf("StartReturn: %v", err)
+	}
+	waitForStatus(t, rentals, &tx, models.StatusReturned)
+
+	var history []models.TransactionStatusChange
+	db.Where("transaction_id = ?", tx.ID).Order("id").Find(&history)
+	var steps []string
+	for _, change := range history {
+		steps = append(steps, string(change.To))
+	}
+	if got, want := strings.Join(steps, " "), "Paid Dispensing Ongoing Returning Returned"; got != want {
+		t.Errorf("status history = %s, want %s", got, want)
+	}
+
+	var opens []esp32.Command
+	for _, cmd := range simulator.Commands() {
+		if cmd.Action == "open" {
+			opens = append(opens, cmd)
+		}
+	}
+	if len(opens) != 2 || opens[0].Slot != *tx.OriginSlotIndex || opens[1].Slot != *tx.ReturnSlotIndex {
+		t.Errorf("open commands = %+v, want the origin then the return slot", opens)
+	}
+
+	var pb models.Powerbank
+	db.First(&pb, *tx.PowerbankID)
+	if pb.Status != models.PowerbankAvailable || pb.CurrentStationID == nil || *pb.CurrentStationID != station.ID {
+		t.Errorf("returned powerbank is %s at station %v, want available at %d", pb.Status, pb.CurrentStationID, station.ID)
+	}
+	db.First(&station, station.ID)
+	if station.PowerbankLeft != 2 {
+		t.Errorf("station has %d powerbanks left, want 2", station.PowerbankLeft)
+	}
+
+	// The deposit is settled right after the rental is closed
+	var ledger []models.LedgerEntry
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if db.Where("transaction_id = ?", tx.ID).Order("id").Find(&ledger); len(ledger) == 3 {
+			break
+		}
+	}
+	var kinds []string
+	for _, entry := range ledger {
+		if entry.Status != models.LedgerSucceeded {
+			t.Errorf("%s of %d is %s", entry.Kind, entry.Amount, entry.Status)
+		}
+		kinds = append(kinds, entry.Kind)
+	}
+	if got, want := strings.Join(kinds, " "), "deposit charge refund"; got != want {
+		t.Fatalf("ledger = %s, want %s", got, want)
+	}
+	if ledger[0].Amount != tx.GrossAmount || ledger[1].Amount != tx.FinalAmount || ledger[2].Amount != tx.GrossAmount-tx.FinalAmount {
+		t.Errorf("ledger amounts = %d, %d, %d for a deposit of %d and a charge of %d",
+			ledger[0].Amount, ledger[1].Amount, ledger[2].Amount, tx.GrossAmount, tx.FinalAmount)
+	}
+	gateway.mu.Lock()
+	defer gateway.mu.Unlock()
+	if len(gateway.refunds) != 1 || gateway.refunds[0].Amount != tx.GrossAmount-tx.FinalAmount {
+		t.Errorf("refunds sent to Midtrans = %+v", gateway.refunds)
+	}
+}
@@ -0,0 +1,282 @@
+package rental
+
+import (
+	"errors"
+	"fmt"
+	"kbt-cuy/billing"
+	"kbt-cuy/models"
+	"kbt-cuy/pricing"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/midtrans/midtrans-go"
+	"github.com/midtrans/midtrans-go/coreapi"
+	"github.com/midtrans/midtrans-go/snap"
+	"gorm.io/gorm"
+)
+
+// Checkout is the part of the Midtrans Snap client used to take a deposit
+type Checkout interface {
+	CreateTransaction(req *snap.Request) (*snap.Response, *midtrans.Error)
+}
+
+// PaymentChecker is the part of the Midtrans core API client used to look up a payment
+type PaymentChecker interface {
+	CheckTransaction(orderID string) (*coreapi.TransactionStatusResponse, *midtrans.Error)
+}
+
+// Reasons CreateOrder and SyncPayment fail
+var (
+	ErrTariffUnavailable = errors.New("failed to load tariff")
+	ErrPaymentGateway    = errors.New("failed to create transaction")
+	ErrPaymentUnchecked  = errors.New("failed to verify transaction status")
+	ErrAmountMismatch    = errors.New("payment does not match the deposit")
+)
+
+// CreateOrder takes the deposit for a rental at the station: it creates the
+// Midtrans Snap transaction and stores the Pending rental with its token
+func (s *Service) CreateOrder(userID, stationID uint) (models.Transaction, error) {
+	var user models.User
+	s.DB.First(&user, userID)
+
+	// Don't take a deposit for a cabinet that can't dispense
+	var station models.PowerbankStation
+	if err := s.DB.Scopes(models.IsOnline).First(&station, stationID).Error; err != nil {
+		return models.Transaction{}, ErrStationOffline
+	}
+
+	plan, err := s.Pricing.PlanFor(stationID)
+	if err != nil {
+		return models.Transaction{}, fmt.Errorf("%w: %v", ErrTariffUnavailable, err)
+	}
+	amount := pricing.Upfront(plan, time.Now())
+	var planID *uint
+	if plan.ID != 0 {
+		planID = &plan.ID
+	}
+
+	orderID := "ORDER-" + strconv.FormatInt(time.Now().Unix(), 10)
+
+	snapReq := &snap.Request{
+		TransactionDetails: midtrans.TransactionDetails{
+			OrderID:  orderID,
+			GrossAmt: amount,
+		},
+		CreditCard: &snap.CreditCardDetails{
+			Secure: true,
+		},
+		CustomerDetail: &midtrans.CustomerDetails{
+			FName: user.Username,
+			Email: user.Email,
+		},
+		Items: &[]midtrans.ItemDetails{
+			{
+				ID:    strconv.FormatUint(uint64(stationID), 10),
+				Name:  "Powerbank Rental",
+				Price: amount,
+				Qty:   1,
+			},
+		},
+	}
+
+	snapResp, snapErr := s.Checkout.CreateTransaction(snapReq)
+	if snapErr != nil {
+		return models.Transaction{}, fmt.Errorf("%w: %w", ErrPaymentGateway, snapErr)
+	}
+
+	transaction := models.Transaction{
+		UserID:                   userID,
+		PowerbankStationOriginID: stationID,
+		Status:                   models.StatusPending,
+		OrderID:                  orderID,
+		GrossAmount:              amount,
+		TariffPlanID:             planID,
+		PaymentToken:             snapResp.Token,
+		PaymentRedirectURL:       snapResp.RedirectURL,
+	}
+
+	if err := s.DB.Create(&transaction).Error; err != nil {
+		return models.Transaction{}, fmt.Errorf("failed to save transaction: %w", err)
+	}
+	return transaction, nil
+}
+
+// SyncPayment asks Midtrans about the rental's payment and applies the
+// outcome: a settled payment dispenses the powerbank, a denied, expired or
+// cancelled one fails the rental. The transaction is reloaded afterwards.
+// A settlement whose amount doesn't match the deposit is never accepted and
+// returns ErrAmountMismatch.
+func (s *Service) SyncPayment(transaction *models.Transaction) error {
+	transactionStatus, merr := s.Payments.CheckTransaction(transaction.OrderID)
+	if merr != nil {
+		return fmt.Errorf("%w: %w", ErrPaymentUnchecked, merr)
+	}
+	if transactionStatus == nil {
+		return nil
+	}
+
+	// Payment is confirmed by Midtrans
+	if PaymentSettled(transactionStatus) {
+		if !AmountMatches(*transaction, transactionStatus.GrossAmount) {
+			log.Printf("[PAYMENT] Order %s settled with gross amount %s, expected %d",
+				transaction.OrderID, transactionStatus.GrossAmount, transaction.GrossAmount)
+			return ErrAmountMismatch
+		}
+		// Check if we need to process the rental (state is still "Pending")
+		if transaction.Status == models.StatusPending {
+			s.ConfirmPayment(transaction.OrderID)
+			// After processing, let's check the new status of our internal transaction
+			s.DB.First(transaction, transaction.ID)
+		}
+		return nil
+	}
+
+	switch transactionStatus.TransactionStatus {
+	case "deny", "expire", "cancel":
+		// Handle failed payment
+		if transaction.Status.CanTransitionTo(models.StatusFailed) {
+			if err := models.Transition(s.DB, transaction, models.StatusFailed, "payment "+transactionStatus.TransactionStatus); err != nil {
+				log.Printf("[PAYMENT] Order %s: %v", transaction.OrderID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// AmountMatches compares a Midtrans gross_amount such as "10000.00" with the stored amount
+func AmountMatches(transaction models.Transaction, grossAmount string) bool {
+	amount, err := strconv.ParseFloat(grossAmount, 64)
+	if err != nil {
+		return false
+	}
+	return amount == float64(transaction.GrossAmount)
+}
+
+// PaymentSettled reports whether Midtrans has confirmed the payment
+func PaymentSettled(status *coreapi.TransactionStatusResponse) bool {
+	return status.TransactionStatus == "capture" || status.TransactionStatus == "settlement"
+}
+
+// ConfirmPayment handles the logic for a successful rental. It is called
+// by both the Midtrans webhook and the payment status poller, possibly at
+// the same time for the same order, so the whole allocation runs in one DB
+// transaction guarded by conditional updates.
+func (s *Service) ConfirmPayment(orderID string) {
+	var tx models.Transaction
+	if err := s.DB.Where("order_id = ?", orderID).First(&tx).Error; err != nil {
+		return
+	}
+
+	if tx.Status != models.StatusPending {
+		return
+	}
+
+	var station models.PowerbankStation
+	err := s.DB.Transaction(func(dbTx *gorm.DB) error {
+		// Idempotency guard: only the caller that moves this order out of
+		// "Pending" gets to allocate a powerbank, everyone else stops here.
+		if err := models.Transition(dbTx, &tx, models.StatusPaid, "payment settled"); err != nil {
+			return err
+		}
+		if err := billing.RecordDeposit(dbTx, tx); err != nil {
+			return err
+		}
+
+		if err := dbTx.First(&station, tx.PowerbankStationOriginID).Error; err != nil {
+			return err
+		}
+
+		pb, slot, err := claimPowerbank(dbTx, station.ID)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return models.Transition(dbTx, &tx, models.StatusFailed, "no powerbank available")
+		}
+		if err != nil {
+			return err
+		}
+
+		deadline := s.DispenseDeadline(time.Now())
+		tx.PowerbankID = &pb.ID
+		tx.OriginSlotIndex = &slot.Index
+		tx.DispenseDeadline = &deadline
+		if err := dbTx.Model(&tx).Updates(map[string]interface{}{
+			"powerbank_id":      pb.ID,
+			"origin_slot_index": slot.Index,
+			"dispense_deadline": deadline,
+		}).Error; err != nil {
+			return err
+		}
+		if err := models.SyncStationStock(dbTx, station.ID); err != nil {
+			return err
+		}
+		return models.Transition(dbTx, &tx, models.StatusDispensing,
+			fmt.Sprintf("powerbank %s assigned from slot %d", pb.PowerbankCode, slot.Index))
+	})
+	if err != nil {
+		if !errors.Is(err, models.ErrStaleTransition) {
+			log.Printf("[PAYMENT] Order %s: allocation failed: %v", orderID, err)
+		}
+		return
+	}
+
+	if tx.Status == models.StatusFailed {
+		// Nothing was dispensed, give the whole deposit back. A refund that
+		// doesn't go through is sent again by Watch.
+		if err := s.Billing.RefundAll(tx, "No powerbank available at station"); err != nil {
+			log.Printf("[PAYMENT] Order %s: refund failed: %v", orderID, err)
+			return
+		}
+		if err := models.Transition(s.DB, &tx, models.StatusRefunded, "deposit refunded"); err != nil {
+			log.Printf("[PAYMENT] Order %s: %v", orderID, err)
+		}
+		return
+	}
+
+	if tx.Status != models.StatusDispensing {
+		return
+	}
+
+	// The rental starts when the cabinet reports the powerbank was taken,
+	// see ConfirmDispense. If the lock didn't even acknowledge the open,
+	// nothing can be taken and we roll back now.
+	if err := s.Locks.For(station).Open(station, *tx.OriginSlotIndex); err != nil {
+		log.Printf("[PAYMENT] Order %s: failed to open slot %d at %s: %v", orderID, *tx.OriginSlotIndex, station.Name, err)
+		if err := s.AbortDispense(&tx, "lock did not open: "+err.Error()); err != nil {
+			log.Printf("[PAYMENT] Order %s: rollback failed: %v", orderID, err)
+		}
+	}
+}
+
+// claimPowerbank marks one available powerbank at the station as rented.
+// The update is conditional on the unit still being available, so a unit
+// can never be handed to two orders. The unit stays in its slot until the
+// cabinet reports it taken, see ConfirmDispense, so the slot can't be
+// reserved for a return meanwhile. Returns gorm.ErrRecordNotFound if the
+// station has nothing left.
+func claimPowerbank(dbTx *gorm.DB, stationID uint) (models.Powerbank, models.StationSlot, error) {
+	var candidates []models.StationSlot
+	if err := dbTx.Joins("Powerbank").
+		Where("station_slots.station_id = ? AND station_slots.faulty = ? AND Powerbank.status = ?", stationID, false, models.PowerbankAvailable).
+		Order("station_slots.slot_index").Find(&candidates).Error; err != nil {
+		return models.Powerbank{}, models.StationSlot{}, err
+	}
+
+	for _, slot := range candidates {
+		pb := *slot.Powerbank
+		result := dbTx.Model(&models.Powerbank{}).
+			Where("id = ? AND current_station_id = ? AND status = ?", pb.ID, stationID, models.PowerbankAvailable).
+			Updates(map[string]interface{}{"status": models.PowerbankRented, "current_station_id": nil})
+		if result.Error != nil {
+			return models.Powerbank{}, models.StationSlot{}, result.Error
+		}
+		if result.RowsAffected == 0 {
+			continue
+		}
+
+		pb.Status = models.PowerbankRented
+		pb.CurrentStationID = nil
+		slot.Powerbank = nil
+		return pb, slot, nil
+	}
+	return models.Powerbank{}, models.StationSlot{}, gorm.ErrRecordNotFound
+}
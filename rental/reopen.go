@@ -0,0 +1,49 @@
+package rental
+
+import (
+	"errors"
+	"kbt-cuy/models"
+	"log"
+
+	"gorm.io/gorm"
+)
+
+// ErrNothingToOpen is returned by Reopen for a rental that has no slot waiting on the user
+var ErrNothingToOpen = errors.New("rental has no slot to open")
+
+// Reopen opens the slot the user's rental is waiting on again, in case the
+// door closed too early: the dispensing slot until the cabinet reports the
+// powerbank taken, the reserved slot while it is being returned. Once a
+// rental is Ongoing its origin slot may hold someone else's powerbank, so
+// there is nothing to open.
+func (s *Service) Reopen(userID, txID uint) (models.Transaction, error) {
+	var tx models.Transaction
+	err := s.DB.Preload("PowerbankStationOrigin").Preload("PowerbankStationReturn").
+		Where("id = ? AND user_id = ?", txID, userID).First(&tx).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return tx, ErrRentalNotFound
+	}
+	if err != nil {
+		return tx, err
+	}
+
+	var station models.PowerbankStation
+	var slot *int
+	switch tx.Status {
+	case models.StatusDispensing:
+		station, slot = tx.PowerbankStationOrigin, tx.OriginSlotIndex
+	case models.StatusReturning:
+		if tx.PowerbankStationReturn != nil {
+			station, slot = *tx.PowerbankStationReturn, tx.ReturnSlotIndex
+		}
+	}
+	if slot == nil {
+		return tx, ErrNothingToOpen
+	}
+
+	if err := s.Locks.For(station).Open(station, *slot); err != nil {
+		log.Printf("[RENTAL] Transaction %d: failed to reopen slot %d at %s: %v", tx.ID, *slot, station.Name, err)
+		return tx, ErrSlotNotOpened
+	}
+	return tx, nil
+}
@@ -0,0 +1,245 @@
+package rental
+
+import (
+	"errors"
+	"fmt"
+	"kbt-cuy/esp32"
+	"kbt-cuy/models"
+	"kbt-cuy/pricing"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Reasons StartReturn refuses a return
+var (
+	ErrRentalNotFound  = errors.New("rental not found")
+	ErrNotReturnable   = errors.New("rental is not ongoing")
+	ErrStationNotFound = errors.New("station not found")
+	ErrStationOffline  = errors.New("station is offline")
+	ErrStationFull     = errors.New("station has no free slot")
+	ErrSlotNotOpened   = errors.New("return slot could not be opened")
+)
+
+var (
+	// ErrMissingCode is returned for an insertion the cabinet couldn't read a code for
+	ErrMissingCode = errors.New("insertion reported without a powerbank code")
+	// ErrUnexpectedPowerbank is returned when the inserted unit isn't the one being returned to the slot
+	ErrUnexpectedPowerbank = errors.New("powerbank is not expected in this slot")
+)
+
+// ReturnDeadline is when a return started at the given time is cancelled if
+// the cabinet still hasn't detected the powerbank
+func (s *Service) ReturnDeadline(now time.Time) time.Time {
+	return now.Add(s.ReturnTimeout)
+}
+
+// StartReturn reserves a free slot at the station for the user's ongoing
+// rental, moves it to Returning and opens the slot. Ownership, state and
+// capacity are checked in the same DB transaction that reserves the slot.
+// The returned rental has its Powerbank and PowerbankStationReturn loaded.
+func (s *Service) StartReturn(userID, txID, stationID uint) (models.Transaction, error) {
+	var tx models.Transaction
+	var station models.PowerbankStation
+	var slot models.StationSlot
+
+	err := s.DB.Transaction(func(dbTx *gorm.DB) error {
+		// Someone else's rental is reported as missing, not as forbidden
+		err := dbTx.Preload("Powerbank").Where("id = ? AND user_id = ?", txID, userID).First(&tx).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrRentalNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if tx.Status != models.StatusOngoing || tx.PowerbankID == nil {
+			return ErrNotReturnable
+		}
+
+		err = dbTx.Scopes(models.WithStock).First(&station, stationID).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrStationNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if !station.Online {
+			return ErrStationOffline
+		}
+
+		slot, err = models.ReserveEmptySlot(dbTx, station.ID, *tx.PowerbankID)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrStationFull
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := models.Transition(dbTx, &tx, models.StatusReturning, "returning at "+station.Name); err != nil {
+			if errors.Is(err, models.ErrStaleTransition) {
+				return ErrNotReturnable
+			}
+			return err
+		}
+
+		deadline := s.ReturnDeadline(time.Now())
+		tx.PowerbankStationReturnID = &station.ID
+		tx.PowerbankStationReturn = &station
+		tx.ReturnSlotIndex = &slot.Index
+		tx.ReturnDeadline = &deadline
+		return dbTx.Model(&tx).Updates(map[string]interface{}{
+			"powerbank_station_return_id": station.ID,
+			"return_slot_index":           slot.Index,
+			"return_deadline":             deadline,
+		}).Error
+	})
+	if err != nil {
+		return tx, err
+	}
+
+	// The rental is closed when the cabinet detects the powerbank in the
+	// slot, see ConfirmReturn
+	if err := s.Locks.For(station).Open(station, slot.Index); err != nil {
+		log.Printf("[RENTAL] Transaction %d: failed to open return slot %d at %s: %v", tx.ID, slot.Index, station.Name, err)
+		if err := s.CancelReturn(&tx, "lock did not open: "+err.Error()); err != nil {
+			log.Printf("[RENTAL] Transaction %d: cancelling return failed: %v", tx.ID, err)
+		}
+		return tx, ErrSlotNotOpened
+	}
+	return tx, nil
+}
+
+// ConfirmReturn closes the rental whose powerbank the cabinet detected in
+// the slot reserved for it. The rental is charged up to the reported time.
+// A missing or unknown code, or a unit that isn't expected in the slot,
+// flags the rentals involved for review and closes nothing.
+func (s *Service) ConfirmReturn(ev esp32.Event) error {
+	var tx models.Transaction
+	expecting := s.DB.Preload("Powerbank").
+		Where("status = ? AND powerbank_station_return_id = ? AND return_slot_index = ?", models.StatusReturning, ev.StationID, ev.Slot).
+		Order("id DESC").Limit(1).Find(&tx).RowsAffected == 1
+
+	if ev.PowerbankCode == "" {
+		if expecting {
+			s.flag(tx.ID, fmt.Sprintf("slot %d reported an insertion without a powerbank code", ev.Slot))
+		}
+		return ErrMissingCode
+	}
+	if expecting && ev.PowerbankCode == tx.Powerbank.PowerbankCode {
+		return s.finishReturn(&tx, ev)
+	}
+
+	note := fmt.Sprintf("powerbank %s was inserted into slot %d of station %d", ev.PowerbankCode, ev.Slot, ev.StationID)
+	if expecting {
+		s.flag(tx.ID, note+", expected "+tx.Powerbank.PowerbankCode)
+	}
+
+	// The unit may belong to another rental that wasn't returned here
+	var other models.Transaction
+	if s.DB.Joins("JOIN powerbanks ON powerbanks.id = transactions.powerbank_id").
+		Where("powerbanks.powerbank_code = ? AND transactions.status IN ?", ev.PowerbankCode,
+			[]models.TransactionStatus{models.StatusOngoing, models.StatusReturning}).
+		Limit(1).Find(&other).RowsAffected == 1 && other.ID != tx.ID {
+		s.flag(other.ID, note+" without a return being started there")
+	}
+	return ErrUnexpectedPowerbank
+}
+
+// finishReturn docks the powerbank in its reserved slot, closes the rental
+// and settles the deposit
+func (s *Service) finishReturn(tx *models.Transaction, ev esp32.Event) error {
+	plan, err := s.Pricing.PlanForTransaction(*tx)
+	if err != nil {
+		return err
+	}
+	rentedAt := tx.CreatedAt
+	if tx.DateRented != nil {
+		rentedAt = *tx.DateRented
+	}
+
+	err = s.DB.Transaction(func(dbTx *gorm.DB) error {
+		if err := models.Transition(dbTx, tx, models.StatusReturned,
+			fmt.Sprintf("powerbank %s detected in slot %d", ev.PowerbankCode, ev.Slot)); err != nil {
+			return err
+		}
+
+		tx.DateReturned = &ev.At
+		tx.FinalAmount = pricing.Charge(plan, rentedAt, ev.At)
+		if err := dbTx.Model(tx).Updates(map[string]interface{}{
+			"date_returned": ev.At,
+			"final_amount":  tx.FinalAmount,
+		}).Error; err != nil {
+			return err
+		}
+
+		// The slot already holds the powerbank since the return was started
+		if err := dbTx.Model(&models.Powerbank{}).Where("id = ?", *tx.PowerbankID).
+			Updates(map[string]interface{}{"status": models.PowerbankAvailable, "current_station_id": ev.StationID}).Error; err != nil {
+			return err
+		}
+		return models.SyncStationStock(dbTx, ev.StationID)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Book the usage charge and refund the rest of the deposit. A refund
+	// that fails is retried by Watch.
+	if err := s.Billing.Settle(*tx); err != nil {
+		log.Printf("[RENTAL] Settling transaction %d failed: %v", tx.ID, err)
+	}
+	return nil
+}
+
+// CancelReturn puts a rental whose powerbank was never detected back to
+// Ongoing and frees the slot that was reserved for it
+func (s *Service) CancelReturn(tx *models.Transaction, reason string) error {
+	return s.DB.Transaction(func(dbTx *gorm.DB) error {
+		if err := models.Transition(dbTx, tx, models.StatusOngoing, reason); err != nil {
+			return err
+		}
+
+		if tx.PowerbankStationReturnID != nil && tx.ReturnSlotIndex != nil && tx.PowerbankID != nil {
+			if err := dbTx.Model(&models.StationSlot{}).
+				Where("station_id = ? AND slot_index = ? AND powerbank_id = ?", *tx.PowerbankStationReturnID, *tx.ReturnSlotIndex, *tx.PowerbankID).
+				Update("powerbank_id", nil).Error; err != nil {
+				return err
+			}
+		}
+
+		// A loaded station would be saved back with its ID by Updates
+		tx.PowerbankStationReturnID = nil
+		tx.PowerbankStationReturn = nil
+		tx.ReturnSlotIndex = nil
+		tx.ReturnDeadline = nil
+		return dbTx.Model(tx).Updates(map[string]interface{}{
+			"powerbank_station_return_id": nil,
+			"return_slot_index":           nil,
+			"return_deadline":             nil,
+		}).Error
+	})
+}
+
+// ExpireReturns cancels every return still Returning after its deadline and
+// returns how many were cancelled
+func (s *Service) ExpireReturns(now time.Time) (int, error) {
+	var rentals []models.Transaction
+	if err := s.DB.Where("status = ? AND COALESCE(return_deadline, updated_at) < ?", models.StatusReturning, now).
+		Find(&rentals).Error; err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	for i := range rentals {
+		tx := &rentals[i]
+		if err := s.CancelReturn(tx, "powerbank not detected before the return deadline"); err != nil {
+			if !errors.Is(err, models.ErrStaleTransition) {
+				log.Printf("[RENTAL] Transaction %d: cancelling return failed: %v", tx.ID, err)
+			}
+			continue
+		}
+		expired++
+	}
+	return expired, nil
+}
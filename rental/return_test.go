@@ -0,0 +1,230 @@
+package rental
+
+import (
+	"errors"
+	"kbt-cuy/billing"
+	"kbt-cuy/esp32"
+	"kbt-cuy/internal/testdb"
+	"kbt-cuy/models"
+	"kbt-cuy/pricing"
+	"testing"
+	"time"
+
+	"github.com/midtrans/midtrans-go"
+	"github.com/midtrans/midtrans-go/coreapi"
+	"gorm.io/gorm"
+)
+
+// brokenLock is a lock driver whose locks never answer
+type brokenLock struct{}
+
+var errLockDown = errors.New("lock did not answer")
+
+func (brokenLock) Open(models.PowerbankStation, int) error  { return errLockDown }
+func (brokenLock) Close(models.PowerbankStation, int) error { return errLockDown }
+func (brokenLock) Status(models.PowerbankStation, int) (esp32.LockStatus, error) {
+	return esp32.LockUnknown, errLockDown
+}
+
+// returnFixture is an ongoing rental and the stations it could be returned to
+type returnFixture struct {
+	db      *gorm.DB
+	rentals *Service
+	renter  models.User
+	other   models.User
+	rental  models.Transaction
+
+	online models.PowerbankStation // Simulated, with free slots
+	stale  models.PowerbankStation // HTTP station that stopped sending heartbeats
+	full   models.PowerbankStation // One slot occupied, the other faulty
+	broken models.PowerbankStation // Online, but its lock doesn't open
+}
+
+func newReturnFixture(t *testing.T) *returnFixture {
+	t.Helper()
+	db := testdb.Open(t)
+	f := &returnFixture{db: db}
+
+	now := time.Now()
+	lastHeard := now.Add(-time.Hour)
+	f.online = models.PowerbankStation{Name: "Online", Capacity: 2, LockDriver: models.LockDriverSimulator, DeviceSecret: "secret"}
+	f.stale = models.PowerbankStation{Name: "Stale", Capacity: 2, LockDriver: models.LockDriverHTTP, DeviceSecret: "secret", LastSeenAt: &lastHeard}
+	f.full = models.PowerbankStation{Name: "Full", Capacity: 2, LockDriver: models.LockDriverSimulator, DeviceSecret: "secret"}
+	f.broken = models.PowerbankStation{Name: "Broken", Capacity: 2, LockDriver: "broken", DeviceSecret: "secret", LastSeenAt: &now}
+	for _, station := range []*models.PowerbankStation{&f.online, &f.stale, &f.full, &f.broken} {
+		mustCreate(t, db, station)
+	}
+	mustCreate(t, db, &models.Powerbank{PowerbankCode: "PB-DOCKED", Capacity: 10000, Status: models.PowerbankAvailable, CurrentStationID: &f.full.ID})
+	if err := models.EnsureSlots(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(&models.StationSlot{}).Where("station_id = ? AND powerbank_id IS NULL", f.full.ID).
+		Update("faulty", true).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	f.renter = models.User{Username: "renter", Email: "renter@example.com", Password: "x"}
+	f.other = models.User{Username: "other", Email: "other@example.com", Password: "x"}
+	mustCreate(t, db, &f.renter)
+	mustCreate(t, db, &f.other)
+
+	pb := models.Powerbank{PowerbankCode: "PB-RENTED", Capacity: 10000, Status: models.PowerbankRented}
+	mustCreate(t, db, &pb)
+	f.rental = models.Transaction{
+		UserID:                   f.renter.ID,
+		PowerbankID:              &pb.ID,
+		PowerbankStationOriginID: f.online.ID,
+		Status:                   models.StatusOngoing,
+		OrderID:                  "ORDER-1",
+		GrossAmount:              10000,
+		DateRented:               &now,
+	}
+	mustCreate(t, db, &f.rental)
+
+	simulator := esp32.NewSimulator()
+	simulator.Latency = 0
+	simulator.HoldFor = 0
+	locks := esp32.NewRegistry(models.LockDriverSimulator)
+	locks.Register(models.LockDriverSimulator, simulator)
+	locks.Register("broken", brokenLock{})
+
+	f.rentals = &Service{
+		DB:            db,
+		Pricing:       &pricing.Engine{DB: db},
+		Locks:         locks,
+		ReturnTimeout: time.Minute,
+	}
+	return f
+}
+
+func mustCreate(t *testing.T, db *gorm.DB, value interface{}) {
+	t.Helper()
+	if err := db.Create(value).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStartReturn(t *testing.T) {
+	tests := []struct {
+		name string
+		// prepare adjusts the fixture and returns who returns which rental where
+		prepare func(f *returnFixture) (userID, txID, stationID uint)
+		want    error
+	}{
+		{"ongoing rental", func(f *returnFixture) (uint, uint, uint) {
+			return f.renter.ID, f.rental.ID, f.online.ID
+		}, nil},
+		{"another user's rental", func(f *returnFixture) (uint, uint, uint) {
+			return f.other.ID, f.rental.ID, f.online.ID
+		}, ErrRentalNotFound},
+		{"unknown rental", func(f *returnFixture) (uint, uint, uint) {
+			return f.renter.ID, f.rental.ID + 100, f.online.ID
+		}, ErrRentalNotFound},
+		{"pending rental", withStatus(models.StatusPending), ErrNotReturnable},
+		{"returned rental", withStatus(models.StatusReturned), ErrNotReturnable},
+		{"rental already returning", withStatus(models.StatusReturning), ErrNotReturnable},
+		{"rental without powerbank", func(f *returnFixture) (uint, uint, uint) {
+			f.db.Model(&f.rental).Update("powerbank_id", nil)
+			return f.renter.ID, f.rental.ID, f.online.ID
+		}, ErrNotReturnable},
+		{"unknown station", func(f *returnFixture) (uint, uint, uint) {
+			return f.renter.ID, f.rental.ID, f.broken.ID + 100
+		}, ErrStationNotFound},
+		{"station without heartbeat", func(f *returnFixture) (uint, uint, uint) {
+			return f.renter.ID, f.rental.ID, f.stale.ID
+		}, ErrStationOffline},
+		{"station occupied or faulty", func(f *returnFixture) (uint, uint, uint) {
+			return f.renter.ID, f.rental.ID, f.full.ID
+		}, ErrStationFull},
+		{"lock does not open", func(f *returnFixture) (uint, uint, uint) {
+			return f.renter.ID, f.rental.ID, f.broken.ID
+		}, ErrSlotNotOpened},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newReturnFixture(t)
+			userID, txID, stationID := tt.prepare(f)
+			var before models.Transaction
+			f.db.First(&before, f.rental.ID)
+
+			_, err := f.rentals.StartReturn(userID, txID, stationID)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("StartReturn = %v, want %v", err, tt.want)
+			}
+
+			var after models.Transaction
+			f.db.First(&after, f.rental.ID)
+			switch {
+			case tt.want == nil:
+				if after.Status != models.StatusReturning || after.ReturnSlotIndex == nil {
+					t.Errorf("rental is %s with return slot %v, want Returning with a slot", after.Status, after.ReturnSlotIndex)
+				}
+			case after.Status != before.Status || after.PowerbankStationReturnID != nil:
+				t.Errorf("rejected return changed the rental: %s -> %s, return station %v", before.Status, after.Status, after.PowerbankStationReturnID)
+			}
+
+			// Only a successful return keeps a slot reserved
+			var reserved int64
+			f.db.Model(&models.StationSlot{}).Where("powerbank_id = ?", f.rental.PowerbankID).Count(&reserved)
+			if want := map[bool]int64{true: 1, false: 0}[tt.want == nil]; reserved != want {
+				t.Errorf("%d slot(s) hold the rented powerbank, want %d", reserved, want)
+			}
+		})
+	}
+}
+
+// withStatus puts the fixture's rental in the given status
+func withStatus(status models.TransactionStatus) func(f *returnFixture) (uint, uint, uint) {
+	return func(f *returnFixture) (uint, uint, uint) {
+		f.db.Model(&f.rental).Update("status", status)
+		return f.renter.ID, f.rental.ID, f.online.ID
+	}
+}
+
+func TestStartReturnWhileDispensing(t *testing.T) {
+	f := newReturnFixture(t)
+	single := models.PowerbankStation{Name: "Single", Capacity: 1, LockDriver: models.LockDriverSimulator, DeviceSecret: "secret"}
+	mustCreate(t, f.db, &single)
+	docked := models.Powerbank{PowerbankCode: "PB-SINGLE", Capacity: 10000, Status: models.PowerbankAvailable, CurrentStationID: &single.ID}
+	mustCreate(t, f.db, &docked)
+	if err := models.EnsureSlots(f.db); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another user pays for the only unit, which is still in its slot
+	order := models.Transaction{UserID: f.other.ID, PowerbankStationOriginID: single.ID, Status: models.StatusPending, OrderID: "ORDER-2", GrossAmount: 10000}
+	mustCreate(t, f.db, &order)
+	f.rentals.DispenseTimeout = time.Minute
+	f.rentals.ConfirmPayment(order.OrderID)
+	f.db.First(&order, order.ID)
+	if order.Status != models.StatusDispensing {
+		t.Fatalf("paid rental is %s, want %s", order.Status, models.StatusDispensing)
+	}
+
+	if _, err := f.rentals.StartReturn(f.renter.ID, f.rental.ID, single.ID); !errors.Is(err, ErrStationFull) {
+		t.Fatalf("StartReturn = %v, want %v", err, ErrStationFull)
+	}
+
+	// Rolling the dispense back leaves the unit ready to rent in its slot
+	f.rentals.Billing = &billing.Service{DB: f.db, Midtrans: refundsAccepted{}}
+	if err := f.rentals.AbortDispense(&order, "powerbank not taken"); err != nil {
+		t.Fatalf("AbortDispense: %v", err)
+	}
+	var slot models.StationSlot
+	f.db.Where("station_id = ?", single.ID).First(&slot)
+	if slot.PowerbankID == nil || *slot.PowerbankID != docked.ID {
+		t.Errorf("slot holds powerbank %v, want %d", slot.PowerbankID, docked.ID)
+	}
+	f.db.First(&docked, docked.ID)
+	f.db.First(&single, single.ID)
+	if docked.Status != models.PowerbankAvailable || single.PowerbankLeft != 1 {
+		t.Errorf("powerbank is %s with %d left at the station, want available with 1", docked.Status, single.PowerbankLeft)
+	}
+}
+
+// refundsAccepted is a Midtrans core API that accepts every refund
+type refundsAccepted struct{}
+
+func (refundsAccepted) RefundTransaction(orderID string, req *coreapi.RefundReq) (*coreapi.RefundResponse, *midtrans.Error) {
+	return &coreapi.RefundResponse{StatusCode: "200"}, nil
+}
@@ -0,0 +1,106 @@
+package rental
+
+import (
+	"context"
+	"fmt"
+	"kbt-cuy/billing"
+	"kbt-cuy/esp32"
+	"kbt-cuy/models"
+	"kbt-cuy/pricing"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Service moves rentals along as the cabinets report what happens at their slots
+type Service struct {
+	DB              *gorm.DB
+	Billing         *billing.Service
+	Pricing         *pricing.Engine
+	Locks           *esp32.Registry
+	Checkout        Checkout       // Midtrans Snap, takes the deposit
+	Payments        PaymentChecker // Midtrans core API, tells whether a deposit was paid
+	DispenseTimeout time.Duration  // How long a paid rental may wait for its powerbank to be taken
+	ReturnTimeout   time.Duration  // How long an opened return slot waits for the powerbank
+}
+
+// HandleEvent applies a slot event reported by a cabinet. It is the
+// esp32.EventHandler of every lock driver.
+func (s *Service) HandleEvent(ev esp32.Event) {
+	var err error
+	switch ev.Kind {
+	case esp32.EventRemoved:
+		err = s.ConfirmDispense(ev)
+	case esp32.EventInserted:
+		err = s.ConfirmReturn(ev)
+	default:
+		err = fmt.Errorf("unknown event %q", ev.Kind)
+	}
+	if err != nil {
+		log.Printf("[RENTAL] Station %d slot %d %s: %v", ev.StationID, ev.Slot, ev.Kind, err)
+	}
+}
+
+// Expected returns the event due next at a slot: the removal of a powerbank
+// being dispensed or the insertion of one being returned. The kind is empty
+// when no rental is waiting on the slot. The simulator acts on it.
+func (s *Service) Expected(stationID uint, slot int) (kind, code string) {
+	var tx models.Transaction
+	if s.DB.Preload("Powerbank").
+		Where("status = ? AND powerbank_station_origin_id = ? AND origin_slot_index = ?", models.StatusDispensing, stationID, slot).
+		Limit(1).Find(&tx).RowsAffected == 1 {
+		return esp32.EventRemoved, tx.Powerbank.PowerbankCode
+	}
+	if s.DB.Preload("Powerbank").
+		Where("status = ? AND powerbank_station_return_id = ? AND return_slot_index = ?", models.StatusReturning, stationID, slot).
+		Limit(1).Find(&tx).RowsAffected == 1 {
+		return esp32.EventInserted, tx.Powerbank.PowerbankCode
+	}
+	return "", ""
+}
+
+// Watch rolls back expired dispenses and returns and retries failed refunds
+// every interval until ctx is cancelled
+func (s *Service) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		if expired, err := s.ExpireDispenses(now); err != nil {
+			log.Printf("[RENTAL] Dispense scan failed: %v", err)
+		} else if expired > 0 {
+			log.Printf("[RENTAL] %d undispensed rental(s) rolled back and refunded", expired)
+		}
+		if expired, err := s.ExpireReturns(now); err != nil {
+			log.Printf("[RENTAL] Return scan failed: %v", err)
+		} else if expired > 0 {
+			log.Printf("[RENTAL] %d undetected return(s) cancelled", expired)
+		}
+		if refunded, err := s.RetryRefunds(now); err != nil {
+			log.Printf("[RENTAL] Refund scan failed: %v", err)
+		} else if refunded > 0 {
+			log.Printf("[RENTAL] %d failed rental(s) refunded on retry", refunded)
+		}
+		if settled, err := s.Billing.RetrySettlements(now); err != nil {
+			log.Printf("[RENTAL] Settlement scan failed: %v", err)
+		} else if settled > 0 {
+			log.Printf("[RENTAL] %d returned rental(s) refunded on retry", settled)
+		}
+	}
+}
+
+// flag leaves a note on a rental for an admin to look at
+func (s *Service) flag(txID uint, note string) {
+	log.Printf("[RENTAL] Transaction %d needs review: %s", txID, note)
+	if err := s.DB.Model(&models.Transaction{}).Where("id = ?", txID).Update("review_note", note).Error; err != nil {
+		log.Printf("[RENTAL] Transaction %d: failed to save review note: %v", txID, err)
+	}
+}